@@ -8,6 +8,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/app-sre/git-partition-sync-producer/pkg"
@@ -16,35 +19,88 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		runVerify(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		runValidate(os.Args[2:])
+		return
+	}
+
 	var dryRun bool
 	var runOnce bool
+	var configFile string
+	var failOnDegraded bool
 	flag.BoolVar(&dryRun, "dry-run", true, "If true, will only print planned actions")
 	flag.BoolVar(&runOnce, "run-once", true, "If true, will exit after single execution")
+	flag.BoolVar(&failOnDegraded, "fail-on-degraded", false,
+		"If true, -run-once exits 2 when at least one sync failed. Otherwise degraded runs exit 0")
+	flag.StringVar(&configFile, "config-file", os.Getenv("CONFIG_FILE"),
+		"Path to yaml or json file of syncs. If set, syncs are not queried from graphql")
 	flag.Parse()
 
 	// define vars to look for and any defaults
 	envVars, err := getEnvVars(map[string]string{
-		"AWS_ACCESS_KEY_ID":         "",
-		"AWS_SECRET_ACCESS_KEY":     "",
-		"AWS_REGION":                "",
-		"AWS_S3_BUCKET":             "",
-		"GITLAB_BASE_URL":           "",
-		"GITLAB_USERNAME":           "",
-		"GITLAB_TOKEN":              "",
-		"GRAPHQL_SERVER":            "",
-		"GRAPHQL_GLSYNC_QUERY_FILE": "./queries/gitlabSync.graphql",
-		"GRAPHQL_USERNAME":          "dev",
-		"GRAPHQL_PASSWORD":          "dev",
-		"INSTANCE_SHARD":            "fedramp",
-		"METRICS_SERVER_PORT":       "9090",
-		"PUBLIC_KEY":                "",
-		"RECONCILE_SLEEP_TIME":      "5m",
-		"WORKDIR":                   "/working",
+		"AWS_ACCESS_KEY_ID":     "",
+		"AWS_SECRET_ACCESS_KEY": "",
+		"AWS_REGION":            "",
+		"AWS_S3_BUCKET":         "",
+		"COMPRESSION":           "gzip",
+		"CONCURRENCY":           "4",
+		"GITLAB_BASE_URL":       "",
+		"GITLAB_USERNAME":       "",
+		"GITLAB_TOKEN":          "",
+		"GRAPHQL_USERNAME":      "dev",
+		"GRAPHQL_PASSWORD":      "dev",
+		"INSTANCE_SHARD":        "fedramp",
+		"METRICS_SERVER_PORT":   "9090",
+		"RECONCILE_SLEEP_TIME":  "5m",
+		"REENCRYPT_LIMIT":       "5",
+		"SECRET_SCAN":           "false",
+		"SHUTDOWN_GRACE_PERIOD": "25s",
+		"VERIFY_ARCHIVES":       "false",
+		"WORKDIR":               "/working",
 	})
 	if err != nil {
 		log.Fatalln(err)
 	}
 
+	concurrency, err := strconv.Atoi(envVars["CONCURRENCY"])
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	gracePeriod, err := time.ParseDuration(envVars["SHUTDOWN_GRACE_PERIOD"])
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	verifyArchives, err := strconv.ParseBool(envVars["VERIFY_ARCHIVES"])
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	secretScan, err := strconv.ParseBool(envVars["SECRET_SCAN"])
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	reencryptLimit, err := strconv.Atoi(envVars["REENCRYPT_LIMIT"])
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	configSource, err := newConfigSource(configFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// SIGTERM (pod termination) and SIGINT cancel ctx. in flight uploads are
+	// allowed to finish within grace period before the process exits
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
 	var sleepDur time.Duration
 	if !runOnce {
 		sleepDur, err = time.ParseDuration(envVars["RECONCILE_SLEEP_TIME"])
@@ -59,48 +115,99 @@ func main() {
 		}()
 	}
 
-	prCheckEarlyExit(envVars)
+	// early exit compares graphql bundles so it does not apply to a config file
+	if configFile == "" {
+		prCheckEarlyExit(ctx, envVars)
+	}
 
+	// clients are created once. config is refreshed before each subsequent run
+	uploader, err := pkg.NewUploader(ctx, pkg.UploaderConfig{
+		AWSAccessKey:          envVars["AWS_ACCESS_KEY_ID"],
+		AWSSecretKey:          envVars["AWS_SECRET_ACCESS_KEY"],
+		AWSRegion:             envVars["AWS_REGION"],
+		Bucket:                envVars["AWS_S3_BUCKET"],
+		GitlabURL:             envVars["GITLAB_BASE_URL"],
+		GitlabUsername:        envVars["GITLAB_USERNAME"],
+		GitlabToken:           envVars["GITLAB_TOKEN"],
+		ConfigSource:          configSource,
+		PublicKey:             os.Getenv("PUBLIC_KEY"),
+		PublicKeyFile:         os.Getenv("PUBLIC_KEY_FILE"),
+		Workdir:               envVars["WORKDIR"],
+		Concurrency:           concurrency,
+		GracePeriod:           gracePeriod,
+		VerifyArchives:        verifyArchives,
+		Compression:           envVars["COMPRESSION"],
+		Instance:              envVars["INSTANCE_SHARD"],
+		SecretScan:            secretScan,
+		SecretScanRules:       os.Getenv("SECRET_SCAN_RULES"),
+		MaxSize:               os.Getenv("MAX_ARTIFACT_SIZE"),
+		MaxObjectSize:         os.Getenv("MAX_OBJECT_SIZE"),
+		ReencryptLimit:        reencryptLimit,
+		SigningKey:            os.Getenv("SIGNING_KEY"),
+		RecipientAliases:      os.Getenv("RECIPIENT_ALIASES"),
+		PublicKeyFingerprints: os.Getenv("PUBLIC_KEY_FINGERPRINTS"),
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			log.Println("Shutdown requested. Exiting")
+			return
+		}
+		log.Fatalln(err)
+	}
+
+	first := true
 	for {
 		status := 0
 		start := time.Now()
 
-		ctx := context.Background()
-		uploader, err := pkg.NewUploader(
-			ctx,
-			envVars["AWS_ACCESS_KEY_ID"],
-			envVars["AWS_SECRET_ACCESS_KEY"],
-			envVars["AWS_REGION"],
-			envVars["AWS_S3_BUCKET"],
-			envVars["GITLAB_BASE_URL"],
-			envVars["GITLAB_USERNAME"],
-			envVars["GITLAB_TOKEN"],
-			envVars["GRAPHQL_SERVER"],
-			envVars["GRAPHQL_GLSYNC_QUERY_FILE"],
-			envVars["GRAPHQL_USERNAME"],
-			envVars["GRAPHQL_PASSWORD"],
-			envVars["PUBLIC_KEY"],
-			envVars["WORKDIR"],
-		)
-		if err != nil {
-			log.Fatalln(err)
+		// the first run uses config loaded by NewUploader
+		if !first {
+			if err := uploader.Refresh(ctx); err != nil {
+				if ctx.Err() != nil {
+					log.Println("Shutdown requested. Exiting")
+					return
+				}
+				log.Println(err)
+			}
 		}
+		first = false
 
-		err = uploader.Run(ctx, dryRun)
+		result, err := uploader.Run(ctx, dryRun)
 		if err != nil {
 			if runOnce {
 				log.Fatalln(err)
 			} else {
 				log.Println(err)
-				status = 1
+				status = int(pkg.RunFailure)
+			}
+		} else {
+			status = int(result.Status())
+		}
+
+		if result != nil {
+			for _, sr := range result.Failed() {
+				log.Printf("Failed sync `%s:%s` -> `%s:%s`: %v", sr.SourcePid, sr.SourceBranch,
+					sr.DestinationPid, sr.DestinationBranch, sr.Err)
 			}
 		}
 
 		if runOnce {
-			os.Exit(0)
+			if status == int(pkg.RunDegraded) && !failOnDegraded {
+				os.Exit(0)
+			}
+			os.Exit(status)
 		} else {
 			utils.RecordMetrics(envVars["INSTANCE_SHARD"], status, time.Since(start))
-			time.Sleep(sleepDur)
+			if result != nil {
+				utils.RecordSyncResults(envVars["INSTANCE_SHARD"], result)
+			}
+
+			select {
+			case <-ctx.Done():
+				log.Println("Shutdown requested. Exiting")
+				return
+			case <-time.After(sleepDur):
+			}
 		}
 	}
 }
@@ -125,7 +232,29 @@ func getEnvVars(vars map[string]string) (map[string]string, error) {
 	return result, nil
 }
 
-func prCheckEarlyExit(envVars map[string]string) {
+// returns source of syncs. a config file takes precedence over graphql
+func newConfigSource(configFile string) (pkg.ConfigSource, error) {
+	if configFile != "" {
+		return pkg.NewFileConfigSource(configFile), nil
+	}
+	envVars, err := getEnvVars(map[string]string{
+		"GRAPHQL_SERVER":            "",
+		"GRAPHQL_GLSYNC_QUERY_FILE": "./queries/gitlabSync.graphql",
+		"GRAPHQL_USERNAME":          "dev",
+		"GRAPHQL_PASSWORD":          "dev",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%v (or CONFIG_FILE)", err)
+	}
+	return pkg.NewGraphqlConfigSource(
+		envVars["GRAPHQL_SERVER"],
+		envVars["GRAPHQL_GLSYNC_QUERY_FILE"],
+		envVars["GRAPHQL_USERNAME"],
+		envVars["GRAPHQL_PASSWORD"],
+	), nil
+}
+
+func prCheckEarlyExit(ctx context.Context, envVars map[string]string) {
 	// indicates PR check when set
 	prevBundleSha := os.Getenv("PREVIOUS_BUNDLE_SHA")
 	if len(prevBundleSha) > 0 {
@@ -137,10 +266,9 @@ func prCheckEarlyExit(envVars map[string]string) {
 		if saasName == "" {
 			saasName = "saas-git-partition-sync-producer"
 		}
-		ctx := context.Background()
 		canExit, err := utils.EarlyExit(
 			ctx,
-			envVars["GRAPHQL_SERVER"],
+			os.Getenv("GRAPHQL_SERVER"),
 			prCheckGqlFile,
 			envVars["GRAPHQL_USERNAME"],
 			envVars["GRAPHQL_PASSWORD"],
@@ -0,0 +1,211 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// chunk objects are named <artifact key>.part-<5 digit number>
+	CHUNK_SUFFIX = ".part-"
+	// index of a chunked artifact is named <artifact key>.index. it is written once all chunks are uploaded
+	CHUNK_INDEX_SUFFIX = ".index"
+	// bounds of MAX_OBJECT_SIZE. the upper bound is the limit of s3 CopyObject
+	MIN_OBJECT_SIZE = manager.MinUploadPartSize
+	MAX_OBJECT_SIZE = 5 << 30
+)
+
+// chunkIndex lists chunks of an artifact in order
+// concatenating chunks yields the encrypted artifact that would otherwise be uploaded as a single object
+type chunkIndex struct {
+	Artifact string `json:"artifact"`
+	Size     int64  `json:"size"`
+	// sha256 of the concatenated (encrypted) artifact
+	SHA256 string      `json:"sha256"`
+	Chunks []chunkInfo `json:"chunks"`
+}
+
+type chunkInfo struct {
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func chunkKey(objKey string, n int) string {
+	return fmt.Sprintf("%s%s%05d", objKey, CHUNK_SUFFIX, n)
+}
+
+// returns artifact key an object belongs to and whether the object is a chunk or chunk index
+func splitChunkKey(key string) (artifact string, isChunk, isIndex bool) {
+	if i := strings.LastIndex(key, CHUNK_SUFFIX); i >= 0 {
+		return key[:i], true, false
+	}
+	if strings.HasSuffix(key, CHUNK_INDEX_SUFFIX) {
+		return strings.TrimSuffix(key, CHUNK_INDEX_SUFFIX), false, true
+	}
+	return key, false, false
+}
+
+// validates MAX_OBJECT_SIZE. 0 disables chunking
+func validateObjectSize(n int64) error {
+	if n != 0 && (n < MIN_OBJECT_SIZE || n > MAX_OBJECT_SIZE) {
+		return fmt.Errorf("Max object size must be between %s and %s, got %s",
+			formatSize(MIN_OBJECT_SIZE), formatSize(MAX_OBJECT_SIZE), formatSize(n))
+	}
+	return nil
+}
+
+// uploads encrypted artifact read from r to objKey. return is keys of all objects written
+// when chunking is enabled, artifacts larger than u.maxObjectSize are split into chunk objects
+func (u *Uploader) putArtifact(ctx context.Context, objKey string, r io.Reader, metadata map[string]string) ([]string, error) {
+	if u.maxObjectSize == 0 {
+		_, err := u.s3Uploader.Upload(ctx, &s3.PutObjectInput{
+			Bucket:   &u.bucket,
+			Key:      &objKey,
+			Body:     r,
+			Metadata: metadata,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []string{objKey}, nil
+	}
+	return u.putChunked(ctx, objKey, r, metadata)
+}
+
+// uploads r as chunk objects of at most u.maxObjectSize followed by their index
+// the size of the stream is unknown until it ends, so a stream fitting within a single chunk
+// is moved to objKey afterwards. consumers only see chunked artifacts that required splitting
+func (u *Uploader) putChunked(ctx context.Context, objKey string, r io.Reader, metadata map[string]string) ([]string, error) {
+	br := bufio.NewReader(r)
+	index := &chunkIndex{
+		Artifact: objKey,
+		Chunks:   []chunkInfo{},
+	}
+	total := sha256.New()
+	for n := 0; ; n++ {
+		// a chunk is only started if at least one byte remains
+		if _, err := br.Peek(1); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		key := chunkKey(objKey, n)
+		digest := sha256.New()
+		counter := &countingWriter{}
+		chunkMetadata := map[string]string{"chunk": fmt.Sprintf("%d", n)}
+		for k, v := range metadata {
+			chunkMetadata[k] = v
+		}
+		_, err := u.s3Uploader.Upload(ctx, &s3.PutObjectInput{
+			Bucket:   &u.bucket,
+			Key:      &key,
+			Body:     io.TeeReader(io.LimitReader(br, u.maxObjectSize), io.MultiWriter(digest, total, counter)),
+			Metadata: chunkMetadata,
+		})
+		if err != nil {
+			return nil, err
+		}
+		index.Chunks = append(index.Chunks, chunkInfo{
+			Key:    key,
+			Size:   counter.n,
+			SHA256: hex.EncodeToString(digest.Sum(nil)),
+		})
+		index.Size += counter.n
+	}
+
+	switch len(index.Chunks) {
+	case 0:
+		return nil, fmt.Errorf("Artifact %s is empty", objKey)
+	case 1:
+		if err := u.promoteChunk(ctx, index.Chunks[0].Key, objKey, metadata); err != nil {
+			return nil, err
+		}
+		return []string{objKey}, nil
+	}
+
+	index.SHA256 = hex.EncodeToString(total.Sum(nil))
+	body, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	indexKey := objKey + CHUNK_INDEX_SUFFIX
+	contentType := "application/json"
+	err = retry(ctx, "s3_put_chunk_index", s3RetryPolicy, func(ctx context.Context) error {
+		ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
+		defer cancel()
+
+		_, err := u.s3Client.PutObject(ctxTimeout, &s3.PutObjectInput{
+			Bucket:      &u.bucket,
+			Key:         &indexKey,
+			Body:        bytes.NewReader(body),
+			ContentType: &contentType,
+			Metadata:    metadata,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{indexKey}
+	for _, c := range index.Chunks {
+		keys = append(keys, c.Key)
+	}
+	return keys, nil
+}
+
+// copies single chunk to objKey with metadata of an unchunked artifact then removes it
+func (u *Uploader) promoteChunk(ctx context.Context, chunk, objKey string, metadata map[string]string) error {
+	// copy source is url encoded as base64 keys may contain `+` and `/`
+	copySource := url.PathEscape(fmt.Sprintf("%s/%s", u.bucket, chunk))
+	err := retry(ctx, "s3_copy_object", s3RetryPolicy, func(ctx context.Context) error {
+		ctxTimeout, cancel := context.WithTimeout(ctx, time.Minute*5)
+		defer cancel()
+
+		_, err := u.s3Client.CopyObject(ctxTimeout, &s3.CopyObjectInput{
+			Bucket:            &u.bucket,
+			Key:               &objKey,
+			CopySource:        &copySource,
+			Metadata:          metadata,
+			MetadataDirective: types.MetadataDirectiveReplace,
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return retry(ctx, "s3_delete_object", s3RetryPolicy, func(ctx context.Context) error {
+		ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*5)
+		defer cancel()
+
+		_, err := u.s3Client.DeleteObject(ctxTimeout, &s3.DeleteObjectInput{
+			Bucket: &u.bucket,
+			Key:    &chunk,
+		})
+		return err
+	})
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
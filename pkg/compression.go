@@ -0,0 +1,156 @@
+package pkg
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CODEC_NONE = "none"
+	CODEC_GZIP = "gzip"
+	CODEC_ZSTD = "zstd"
+
+	// bounds of explicit levels. levels outside them (ex: gzip 0, no compression) are rejected
+	// rather than silently mapped to another level
+	GZIP_MIN_LEVEL = gzip.BestSpeed
+	GZIP_MAX_LEVEL = gzip.BestCompression
+	ZSTD_MIN_LEVEL = 1
+	ZSTD_MAX_LEVEL = 22
+)
+
+// levels the zstd encoder implements. EncoderLevelFromZstd maps each zstd level to one of them,
+// ex: 10 through 22 are all SpeedBestCompression
+var zstdEffectiveLevels = map[zstd.EncoderLevel]int{
+	zstd.SpeedFastest:           1,
+	zstd.SpeedDefault:           3,
+	zstd.SpeedBetterCompression: 7,
+	zstd.SpeedBestCompression:   11,
+}
+
+// compression describes the codec applied to archives before encryption
+// level is codec specific. zero (level omitted from spec) selects the codec default
+type compression struct {
+	codec string
+	level int
+}
+
+// parses compression spec of format codec[:level]. ex: none, gzip, gzip:9, zstd:19
+// zstd levels are replaced by the level the encoder applies (see zstdEffectiveLevels) so that
+// recorded compression matches the output
+func parseCompression(spec string) (compression, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	c := compression{codec: parts[0]}
+	explicit := len(parts) == 2
+	if explicit {
+		level, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return c, fmt.Errorf("Invalid compression level %q: %v", parts[1], err)
+		}
+		c.level = level
+	}
+
+	switch c.codec {
+	case CODEC_NONE:
+		if explicit {
+			return c, fmt.Errorf("Compression level is not supported by codec %q", c.codec)
+		}
+	case CODEC_GZIP:
+		if explicit && (c.level < GZIP_MIN_LEVEL || c.level > GZIP_MAX_LEVEL) {
+			return c, fmt.Errorf("gzip compression level must be between %d and %d, got %d",
+				GZIP_MIN_LEVEL, GZIP_MAX_LEVEL, c.level)
+		}
+	case CODEC_ZSTD:
+		if explicit && (c.level < ZSTD_MIN_LEVEL || c.level > ZSTD_MAX_LEVEL) {
+			return c, fmt.Errorf("zstd compression level must be between %d and %d, got %d",
+				ZSTD_MIN_LEVEL, ZSTD_MAX_LEVEL, c.level)
+		}
+		if explicit {
+			c.level = zstdEffectiveLevels[zstd.EncoderLevelFromZstd(c.level)]
+		}
+	default:
+		return c, fmt.Errorf("Unsupported compression codec %q. must be one of %s, %s or %s",
+			c.codec, CODEC_NONE, CODEC_GZIP, CODEC_ZSTD)
+	}
+	return c, nil
+}
+
+func (c compression) String() string {
+	if c.level == 0 {
+		return c.codec
+	}
+	return fmt.Sprintf("%s:%d", c.codec, c.level)
+}
+
+// returns file extension of archives compressed with this codec
+func (c compression) extension() string {
+	switch c.codec {
+	case CODEC_GZIP:
+		return ".tar.gz"
+	case CODEC_ZSTD:
+		return ".tar.zst"
+	default:
+		return ".tar"
+	}
+}
+
+// returns writer compressing to w. output is deterministic for a given input
+// closing the writer flushes remaining output but does not close w
+func (c compression) newWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c.codec {
+	case CODEC_GZIP:
+		level := c.level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		gzw, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		gzw.Header = gzip.Header{
+			ModTime: time.Time{}, // zero value omits mtime from header
+			OS:      255,         // unknown. default value set explicitly to not depend on library behavior
+		}
+		return gzw, nil
+	case CODEC_ZSTD:
+		opts := []zstd.EOption{
+			// single goroutine keeps memory bounded and block boundaries stable
+			zstd.WithEncoderConcurrency(1),
+		}
+		if c.level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// returns reader decompressing r. checksums are validated once the reader reaches EOF
+func (c compression) newReader(r io.Reader) (io.ReadCloser, error) {
+	switch c.codec {
+	case CODEC_GZIP:
+		return gzip.NewReader(r)
+	case CODEC_ZSTD:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return io.NopCloser(r), nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigSource provides the syncs an Uploader reconciles
+type ConfigSource interface {
+	// returns syncs and sha256 identifying the config they were loaded from, recorded within provenance
+	// sha is empty when it cannot be determined
+	Load(ctx context.Context) ([]*SyncConfig, string, error)
+}
+
+// graphqlConfigSource queries gitlabSyncs of app-interface from a qontract graphql server
+type graphqlConfigSource struct {
+	url      string
+	file     string
+	username string
+	password string
+}
+
+// NewGraphqlConfigSource returns source querying url with the graphql query within file
+func NewGraphqlConfigSource(url, file, username, password string) ConfigSource {
+	return &graphqlConfigSource{
+		url:      url,
+		file:     file,
+		username: username,
+		password: password,
+	}
+}
+
+func (g *graphqlConfigSource) Load(ctx context.Context) ([]*SyncConfig, string, error) {
+	syncs, err := getConfig(ctx, g.url, g.file, g.username, g.password)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// bundle sha is informational (provenance only) so failure to retrieve it is not fatal
+	bundleSha, err := getBundleSha(ctx, g.url, g.username, g.password)
+	if err != nil {
+		log.Printf("Unable to retrieve config bundle sha: %v", err)
+	}
+	return syncs, bundleSha, nil
+}
+
+// fileConfigSource reads syncs from a local yaml or json file
+// intended for local development and environments without access to a graphql server
+type fileConfigSource struct {
+	path string
+}
+
+// syncFile is the schema of a sync config file. each entry has the schema of a gitlabSync:
+//
+//	gitlabSyncs:
+//	- sourceProject: {name: foo, group: bar, branch: main}
+//	  destinationProject: {name: foo, group: baz, branch: main}
+type syncFile struct {
+	GitlabSyncs []*SyncConfig `yaml:"gitlabSyncs"`
+}
+
+// NewFileConfigSource returns source reading the yaml or json file at path
+// the file is read on every load so edits apply to the next run
+func NewFileConfigSource(path string) ConfigSource {
+	return &fileConfigSource{path: path}
+}
+
+func (f *fileConfigSource) Load(ctx context.Context) ([]*SyncConfig, string, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to read sync config file: %v", err)
+	}
+
+	// unknown fields are rejected so a misspelled field is not silently ignored
+	var cfg syncFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, "", fmt.Errorf("Unable to parse sync config file %s: %v", f.path, err)
+	}
+
+	syncs := []*SyncConfig{}
+	for i, gs := range cfg.GitlabSyncs {
+		if gs == nil {
+			return nil, "", fmt.Errorf("Sync config file %s: gitlabSyncs entry %d is empty", f.path, i)
+		}
+		syncs = append(syncs, gs)
+	}
+
+	digest := sha256.Sum256(data)
+	return syncs, hex.EncodeToString(digest[:]), nil
+}
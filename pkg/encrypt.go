@@ -1,53 +1,270 @@
 package pkg
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"log"
-	"os"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"unicode"
 
 	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
 )
 
-const ENCRYPT_DIRECTORY = "encrypted"
+// recipientSet is the set of age recipients artifacts are encrypted to
+// any identity matching one of them can decrypt, which allows consumer keys to be rotated without a gap
+type recipientSet struct {
+	recipients []age.Recipient
+	// canonical public keys in the order of recipients
+	keys []string
+	// sorted and deduplicated. see recipientFingerprint
+	fingerprints []string
+}
 
-// utilizes x25519 to output encrypted tars
-func (u *Uploader) encryptRepoTars(toUpdate []*SyncConfig) error {
-	err := u.clean(ENCRYPT_DIRECTORY)
-	if err != nil {
-		return err
+// parses public keys separated by commas or newlines. lines starting with # are comments, as within
+// age recipient files. a line starting with ssh- is a single ssh-ed25519 or ssh-rsa key in
+// authorized_keys format, whose comment may contain commas. other entries are x25519 keys
+func parseRecipients(keys string) (*recipientSet, error) {
+	set := &recipientSet{
+		recipients:   []age.Recipient{},
+		keys:         []string{},
+		fingerprints: []string{},
+	}
+	seen := make(map[string]bool)
+	add := func(recipient age.Recipient, key string) {
+		fingerprint := recipientFingerprint(key)
+		if seen[fingerprint] {
+			return
+		}
+		seen[fingerprint] = true
+		set.recipients = append(set.recipients, recipient)
+		set.keys = append(set.keys, key)
+		set.fingerprints = append(set.fingerprints, fingerprint)
+	}
+	for _, line := range strings.Split(keys, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "ssh-") {
+			recipient, key, err := parseSSHRecipient(line)
+			if err != nil {
+				return nil, err
+			}
+			add(recipient, key)
+			continue
+		}
+		for _, key := range strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		}) {
+			recipient, err := age.ParseX25519Recipient(key)
+			if err != nil {
+				return nil, err
+			}
+			add(recipient, recipient.String())
+		}
+	}
+	if len(set.recipients) == 0 {
+		return nil, fmt.Errorf("No recipients configured")
 	}
+	sort.Strings(set.fingerprints)
+	return set, nil
+}
 
-	recipient, err := age.ParseX25519Recipient(u.publicKey)
+// parses ssh public key in authorized_keys format. return includes canonical key without comment
+func parseSSHRecipient(entry string) (age.Recipient, string, error) {
+	recipient, err := agessh.ParseRecipient(entry)
+	if err != nil {
+		return nil, "", err
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(entry))
 	if err != nil {
-		log.Fatalf("Failed to parse public key %q: %v", u.publicKey, err)
+		return nil, "", err
 	}
+	return recipient, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubKey))), nil
+}
 
-	for _, gs := range toUpdate {
-		encryptPath := fmt.Sprintf("%s/%s/%s.tar.age", u.workdir, ENCRYPT_DIRECTORY, gs.Source.ProjectName)
-		f, err := os.Create(encryptPath)
+// returns recipients of publicKey combined with those within publicKeyFile, checked against pins
+// the file is read on every call so rotated keys apply without a restart
+func loadRecipients(publicKey, publicKeyFile string, pins recipientPins) (*recipientSet, error) {
+	if publicKey == "" && publicKeyFile == "" {
+		return nil, fmt.Errorf("Public key or public key file must be configured")
+	}
+	keys := publicKey
+	if publicKeyFile != "" {
+		data, err := ioutil.ReadFile(publicKeyFile)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("Unable to read public key file: %v", err)
 		}
-		defer f.Close()
+		keys = fmt.Sprintf("%s\n%s", keys, data)
+	}
+	recipients, err := parseRecipients(keys)
+	if err == nil {
+		err = pins.check(recipients)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid public key: %v", err)
+	}
+	return recipients, nil
+}
 
-		// read in tar data
-		tarBytes, err := os.ReadFile(gs.tarPath)
-		if err != nil {
-			return err
+// recipientPins is the set of fingerprints artifacts may be encrypted to. nil permits any key
+// pinning guards against a replaced or mistyped key silently publishing artifacts to the wrong party
+type recipientPins map[string]bool
+
+// parses expected fingerprints separated by commas or whitespace. empty disables pinning
+func parseRecipientPins(raw string) (recipientPins, error) {
+	fingerprints := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	if len(fingerprints) == 0 {
+		return nil, nil
+	}
+	pins := make(recipientPins)
+	for _, fingerprint := range fingerprints {
+		if decoded, err := hex.DecodeString(fingerprint); err != nil || len(decoded) != 8 ||
+			fingerprint != strings.ToLower(fingerprint) {
+			return nil, fmt.Errorf("Invalid recipient fingerprint %q. must be 16 lowercase hex characters", fingerprint)
 		}
+		pins[fingerprint] = true
+	}
+	return pins, nil
+}
 
-		// encrypt
-		encWriter, err := age.Encrypt(f, recipient)
-		if err != nil {
-			return err
+// returns error naming keys of set whose fingerprints are not pinned
+func (p recipientPins) check(set *recipientSet) error {
+	if p == nil {
+		return nil
+	}
+	unpinned := []string{}
+	for _, key := range set.keys {
+		if fingerprint := recipientFingerprint(key); !p[fingerprint] {
+			unpinned = append(unpinned, fmt.Sprintf("%s (%s)", key, fingerprint))
 		}
-		encWriter.Write(tarBytes)
+	}
+	if len(unpinned) > 0 {
+		return fmt.Errorf("Recipients not within pinned fingerprints: %s", strings.Join(unpinned, ", "))
+	}
+	return nil
+}
 
-		if err := encWriter.Close(); err != nil {
-			return err
+// parses aliases of recipient sets that syncs may reference instead of keys
+// raw is a yaml or json map of alias to keys accepted by parseRecipients. empty results in no aliases
+func parseRecipientAliases(raw string, pins recipientPins) (map[string]string, error) {
+	aliases := make(map[string]string)
+	if raw == "" {
+		return aliases, nil
+	}
+	if err := yaml.Unmarshal([]byte(raw), &aliases); err != nil {
+		return nil, fmt.Errorf("Unable to parse recipient aliases: %v", err)
+	}
+	for alias, keys := range aliases {
+		recipients, err := parseRecipients(keys)
+		if err == nil {
+			err = pins.check(recipients)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid keys of recipient alias %q: %v", alias, err)
 		}
-		gs.encryptPath = encryptPath
 	}
+	return aliases, nil
+}
 
-	return nil
+// RecipientPolicy is the set of aliases syncs may reference as recipient and the fingerprints
+// every recipient must match
+type RecipientPolicy struct {
+	aliases map[string]string
+	pins    recipientPins
+}
+
+// NewRecipientPolicy parses aliases and fingerprints in the format of RECIPIENT_ALIASES and PUBLIC_KEY_FINGERPRINTS
+// both may be empty, in which case syncs may only name keys and any key is accepted
+func NewRecipientPolicy(aliases, fingerprints string) (*RecipientPolicy, error) {
+	pins, err := parseRecipientPins(fingerprints)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := parseRecipientAliases(aliases, pins)
+	if err != nil {
+		return nil, err
+	}
+	return &RecipientPolicy{aliases: parsed, pins: pins}, nil
+}
+
+// resolves recipient override of gs against aliases. nil if gs has none
+// keys are checked against pins so a sync cannot bypass pinning by naming its own keys
+func (p *RecipientPolicy) resolve(gs *SyncConfig) (*recipientSet, error) {
+	if gs.Recipient == "" {
+		return nil, nil
+	}
+	keys, isAlias := p.aliases[gs.Recipient]
+	if !isAlias {
+		keys = gs.Recipient
+	}
+	recipients, err := parseRecipients(keys)
+	if err != nil {
+		return nil, fmt.Errorf("recipient is not an alias or key: %v", err)
+	}
+	if err := p.pins.check(recipients); err != nil {
+		return nil, fmt.Errorf("recipient: %v", err)
+	}
+	return recipients, nil
+}
+
+// returns recipients artifacts of sync are encrypted to. global unless overridden by the sync
+func (s *SyncConfig) encryptionRecipients(global *recipientSet) *recipientSet {
+	if s.recipients != nil {
+		return s.recipients
+	}
+	return global
+}
+
+// returns short identifier of a recipient recorded within object metadata
+// derived from the canonical public key (age1... or ssh key without comment) so it can be recomputed by anyone holding the key
+func recipientFingerprint(key string) string {
+	digest := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(digest[:8])
+}
+
+// returns fingerprints as recorded within the `recipients` object metadata
+func (s *recipientSet) String() string {
+	return strings.Join(s.fingerprints, ",")
+}
+
+// returns short identifier of the recipient set recorded within object keys
+// artifacts encrypted to different sets are published under different keys
+func (s *recipientSet) digest() string {
+	digest := sha256.Sum256([]byte(s.String()))
+	return hex.EncodeToString(digest[:6])
+}
+
+// utilizes age to stream a tar of repoPath encrypted to all recipients to w
+// return is hex encoded SHA-256 of the compressed unencrypted archive
+// it identifies the exact artifact and can be verified independently after decryption
+func writeEncryptedTar(ctx context.Context, w io.Writer, repoPath string, recipients []age.Recipient,
+	opts archiveOptions) (string, error) {
+	if opts.maxSize > 0 {
+		w = &limitWriter{w: w, limit: opts.maxSize}
+	}
+	encWriter, err := age.Encrypt(w, recipients...)
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha256.New()
+	if err := writeTar(ctx, io.MultiWriter(encWriter, digest), repoPath, opts); err != nil {
+		return "", err
+	}
+
+	// close flushes the final encrypted chunk
+	if err := encWriter.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
 }
@@ -0,0 +1,130 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// pathFilter decides which paths of a repository are packaged
+// patterns are matched against slash separated paths relative to the repository root.
+// `*`, `?` and `[...]` match within a single path segment (see path.Match) and a `**` segment
+// matches any number of segments. a pattern matching a directory applies to everything beneath it
+type pathFilter struct {
+	include [][]string
+	exclude [][]string
+}
+
+// returns nil if neither list contains patterns
+func newPathFilter(include, exclude []string) (*pathFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+
+	f := &pathFilter{}
+	for _, lists := range []struct {
+		patterns []string
+		dest     *[][]string
+	}{
+		{include, &f.include},
+		{exclude, &f.exclude},
+	} {
+		for _, p := range lists.patterns {
+			segments := strings.Split(strings.Trim(p, "/"), "/")
+			for _, s := range segments {
+				if _, err := path.Match(s, ""); err != nil {
+					return nil, fmt.Errorf("Invalid path pattern %q: %v", p, err)
+				}
+			}
+			*lists.dest = append(*lists.dest, segments)
+		}
+	}
+	return f, nil
+}
+
+// returns whether entry name is packaged. directories that are not packaged are not walked
+// directories leading to included paths are packaged so their contents can be reached
+func (f *pathFilter) keeps(name string, isDir bool) bool {
+	segments := strings.Split(name, "/")
+
+	// exclusion takes precedence over inclusion
+	if matchesSelfOrParent(f.exclude, segments) {
+		return false
+	}
+	if len(f.include) == 0 || matchesSelfOrParent(f.include, segments) {
+		return true
+	}
+	if isDir {
+		for _, p := range f.include {
+			if globPrefixMatch(p, segments) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// returns true if name or any of its parent directories match one of patterns
+func matchesSelfOrParent(patterns [][]string, segments []string) bool {
+	for i := 1; i <= len(segments); i++ {
+		for _, p := range patterns {
+			if globMatch(p, segments[:i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reports whether path segments match pattern segments
+func globMatch(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// ** matches zero or more segments
+			for i := 0; i <= len(name); i++ {
+				if globMatch(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// reports whether entries beneath directory dir may match pattern
+func globPrefixMatch(pattern, dir []string) bool {
+	for len(dir) > 0 {
+		if len(pattern) == 0 {
+			return false
+		}
+		if pattern[0] == "**" {
+			return true
+		}
+		if ok, _ := path.Match(pattern[0], dir[0]); !ok {
+			return false
+		}
+		pattern, dir = pattern[1:], dir[1:]
+	}
+	return true
+}
+
+// returns short digest identifying include and exclude lists of a sync. empty if none are set
+// recorded within s3 keys so that artifacts are re-packaged when filters change
+func filterDigest(include, exclude []string) string {
+	if len(include) == 0 && len(exclude) == 0 {
+		return ""
+	}
+	digest := sha256.Sum256([]byte(fmt.Sprintf("include:%s\nexclude:%s",
+		strings.Join(include, "\n"), strings.Join(exclude, "\n"))))
+	return hex.EncodeToString(digest[:6])
+}
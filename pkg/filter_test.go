@@ -0,0 +1,94 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"README.md", "README.md", true},
+		{"README.md", "docs/README.md", false},
+		{"*.pem", "key.pem", true},
+		{"*.pem", "src/key.pem", false},
+		{"**/*.pem", "key.pem", true},
+		{"**/*.pem", "src/key.pem", true},
+		{"**/*.pem", "src/a/b/key.pem", true},
+		{"**/*.pem", "src/key.pem.bak", false},
+		{"src/*", "src/main.go", true},
+		{"src/*", "src/pkg/main.go", false},
+		{"src/**", "src/pkg/main.go", true},
+		{"src/**/test", "src/test", true},
+		{"src/**/test", "src/a/b/test", true},
+		{"src/**/test", "lib/a/test", false},
+		{"?.go", "a.go", true},
+		{"?.go", "ab.go", false},
+		{"[abc].txt", "b.txt", true},
+		{"[abc].txt", "d.txt", false},
+	}
+	for _, tt := range tests {
+		got := globMatch(strings.Split(tt.pattern, "/"), strings.Split(tt.name, "/"))
+		if got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPathFilterKeeps(t *testing.T) {
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		// exclude only
+		{"root anchored exclude", nil, []string{"*.pem"}, "src/x.pem", false, true},
+		{"root anchored exclude at root", nil, []string{"*.pem"}, "x.pem", false, false},
+		{"any depth exclude", nil, []string{"**/*.pem"}, "src/x.pem", false, false},
+		{"any depth exclude at root", nil, []string{"**/*.pem"}, "x.pem", false, false},
+		{"excluded directory", nil, []string{"**/internal"}, "src/internal", true, false},
+		{"beneath excluded directory", nil, []string{"**/internal"}, "src/internal/a/b.go", false, false},
+		{"not excluded", nil, []string{"**/internal"}, "src/internals.go", false, true},
+
+		// include only
+		{"included file", []string{"README.md"}, nil, "README.md", false, true},
+		{"beneath included directory", []string{"src"}, nil, "src/a/b.go", false, true},
+		{"not included", []string{"src"}, nil, "docs/a.md", false, false},
+		{"directory leading to include", []string{"src/pkg"}, nil, "src", true, true},
+		{"file beside include", []string{"src/pkg"}, nil, "src/main.go", false, false},
+		{"directory beside include", []string{"src/pkg"}, nil, "src/cmd", true, false},
+		{"directory leading to glob include", []string{"**/docs"}, nil, "a/b", true, true},
+
+		// exclude takes precedence
+		{"excluded within include", []string{"src"}, []string{"src/secret"}, "src/secret/key", false, false},
+		{"excluded directory within include", []string{"src"}, []string{"src/secret"}, "src/secret", true, false},
+		{"included beside exclude", []string{"src"}, []string{"src/secret"}, "src/public/key", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newPathFilter(tt.include, tt.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.keeps(tt.path, tt.isDir); got != tt.want {
+				t.Errorf("keeps(%q, %v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPathFilter(t *testing.T) {
+	f, err := newPathFilter(nil, nil)
+	if err != nil || f != nil {
+		t.Errorf("newPathFilter(nil, nil) = %v, %v, want nil, nil", f, err)
+	}
+	if _, err := newPathFilter([]string{"src/[a"}, nil); err == nil {
+		t.Error("newPathFilter accepted malformed pattern")
+	}
+}
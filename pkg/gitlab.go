@@ -2,62 +2,221 @@ package pkg
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net/url"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
 )
 
-// keys are gitlab PID (gitlab_group/project_name)
+// keys are source refs (gitlab_group/project_name:branch)
 // values are commit SHA
-type pidToCommit map[string]string
+type refToCommit map[string]string
 
-// returns a map of project PIDs (gitlab_group/project_name) to latest commit on specified source branch
-func (u *Uploader) getLatestGitlabCommits() (pidToCommit, error) {
-	latestCommits := make(pidToCommit)
+// returns a map of source refs (gitlab_group/project_name:branch) to latest commit on that branch
+// syncs sharing a source ref only result in a single lookup
+// a failed lookup is recorded against each sync of the ref and omitted from the returned map
+func (u *Uploader) getLatestGitlabCommits(ctx context.Context, result *RunResult) refToCommit {
+	latestCommits := make(refToCommit)
+	lookupErrs := make(map[string]error)
 	for _, sync := range u.syncs {
-		pid := fmt.Sprintf("%s/%s", sync.Source.Group, sync.Source.ProjectName)
+		// rejected by config validation
+		if result.failed(sync) {
+			continue
+		}
+		ref := sync.sourceRef()
+		if _, exists := latestCommits[ref]; exists {
+			continue
+		}
+		if err, exists := lookupErrs[ref]; exists {
+			result.fail(sync, err)
+			continue
+		}
 		// by default, the latest commit is returned
-		commit, _, err := u.glClient.Commits.GetCommit(pid, sync.Source.Branch, nil)
+		var commit *gitlab.Commit
+		err := retry(ctx, "gitlab_get_commit", gitlabRetryPolicy, func(ctx context.Context) error {
+			var err error
+			commit, _, err = u.glClient.Commits.GetCommit(sync.sourcePid(), sync.Source.Branch,
+				gitlab.WithContext(ctx))
+			return err
+		})
 		if err != nil {
-			return nil, err
+			lookupErrs[ref] = err
+			result.fail(sync, err)
+			continue
 		}
-		latestCommits[pid] = commit.ID
+		latestCommits[ref] = commit.ID
 	}
-	return latestCommits, nil
+	return latestCommits
 }
 
 const CLONE_DIRECTORY = "glrepos"
 
-func (u *Uploader) cloneRepos(toUpdate []*SyncConfig) error {
-	err := u.clean(CLONE_DIRECTORY)
+// clones job source into its workspace within the clone directory
+// each source ref is cloned once regardless of the number of destinations it is synced to
+func (u *Uploader) cloneRepo(ctx context.Context, job *sourceJob) error {
+	authURL, err := u.formatAuthURL(job.pid)
+	if err != nil {
+		return err
+	}
+
+	repoPath := filepath.Join(u.workdir, CLONE_DIRECTORY, job.workspacePath())
+	if err := os.MkdirAll(filepath.Dir(repoPath), 0755); err != nil {
+		return err
+	}
+
+	err = retry(ctx, "git_clone", cloneRetryPolicy, func(ctx context.Context) error {
+		// git refuses to clone into a non empty directory left behind by a failed attempt
+		if err := os.RemoveAll(repoPath); err != nil {
+			return permanent(err)
+		}
+
+		// only the synced branch and tags within its history are fetched so that unrelated branches cannot alter the archive
+		err := u.git(ctx, "", "clone", "--single-branch", "--branch", job.branch, authURL, repoPath)
+		if err != nil && isPermanentCloneFailure(err.Error()) {
+			return permanent(err)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = u.pinClone(ctx, job, repoPath)
 	if err != nil {
 		return err
 	}
 
-	for _, gs := range toUpdate {
-		authURL, err := u.formatAuthURL(fmt.Sprintf("%s/%s", gs.Source.Group, gs.Source.ProjectName))
+	if job.packagesHistory() {
+		err = u.repackClone(ctx, repoPath)
 		if err != nil {
 			return err
 		}
+	}
 
-		args := []string{"-c", fmt.Sprintf("git clone %s", authURL)}
-		cmd := exec.Command("/bin/sh", args...)
-		cmd.Dir = fmt.Sprintf("%s/%s", u.workdir, CLONE_DIRECTORY)
-		var stderr bytes.Buffer
-		cmd.Stderr = &stderr
-		err = cmd.Run()
-		if err != nil {
-			return errors.New(strings.ReplaceAll(stderr.String(), u.glToken, "[REDACTED]"))
+	committedAt, err := commitTime(ctx, repoPath, job.commit)
+	if err != nil {
+		return err
+	}
+
+	job.repoPath = repoPath
+	job.committedAt = committedAt
+	return nil
+}
+
+// returns committer timestamp of commit within repository at dir
+func commitTime(ctx context.Context, dir, commit string) (time.Time, error) {
+	cmd := exec.CommandContext(ctx, "git", "show", "-s", "--format=%ct", commit)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Unable to read commit time of %s: %v", commit, err)
+	}
+	seconds, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Unable to parse commit time of %s: %v", commit, err)
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// normalizes a fresh clone so that its contents depend only on the job commit
+// the branch may have advanced since its latest commit was looked up so it is reset to that commit.
+// credentials embedded within the remote url by clone are also removed so they are never packaged
+func (u *Uploader) pinClone(ctx context.Context, job *sourceJob, repoPath string) error {
+	remoteURL := fmt.Sprintf("%s/%s.git", u.glBaseURL, job.pid)
+	for _, args := range [][]string{
+		{"reset", "--hard", "--quiet", job.commit},
+		{"update-ref", fmt.Sprintf("refs/remotes/origin/%s", job.branch), job.commit},
+		{"remote", "set-url", "origin", remoteURL},
+	} {
+		if err := u.git(ctx, repoPath, args...); err != nil {
+			return permanent(err)
+		}
+	}
+
+	// tags fetched with a branch that advanced past the commit are not part of its history
+	cmd := exec.CommandContext(ctx, "git", "tag", "--no-merged", job.commit)
+	cmd.Dir = repoPath
+	out, err := cmd.Output()
+	if err != nil {
+		return permanent(fmt.Errorf("git tag: %v", err))
+	}
+	if tags := strings.Fields(string(out)); len(tags) > 0 {
+		if err := u.git(ctx, repoPath, append([]string{"tag", "--delete"}, tags...)...); err != nil {
+			return permanent(err)
+		}
+	}
+	return nil
+}
+
+// returns true if any sync of job packages git history
+func (j *sourceJob) packagesHistory() bool {
+	for _, gs := range j.syncs {
+		if mode, _ := gs.exportMode(); mode != MODE_SNAPSHOT {
+			return true
 		}
+	}
+	return false
+}
 
-		gs.repoPath = fmt.Sprintf("%s/%s/%s", u.workdir, CLONE_DIRECTORY, gs.Source.ProjectName)
+// rewrites the objects of a pinned clone into a single pack that depends only on its refs
+// packs sent by the server vary with its own packing (ex: after gc), so every object is recompressed
+// and deltas are searched on a single thread. reflogs are removed first as their entries would keep
+// objects beyond the commit reachable
+func (u *Uploader) repackClone(ctx context.Context, repoPath string) error {
+	for _, path := range []string{".git/logs", ".git/ORIG_HEAD"} {
+		if err := os.RemoveAll(filepath.Join(repoPath, path)); err != nil {
+			return permanent(err)
+		}
+	}
+	err := u.git(ctx, repoPath, "repack", "-a", "-d", "-F", "-n", "-q", "--threads=1")
+	if err != nil {
+		return permanent(err)
 	}
+	return nil
+}
 
+// runs git within dir. process is killed if ctx is done
+// returned error includes stderr with the gitlab token redacted
+func (u *Uploader) git(ctx context.Context, dir string, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return errors.New(strings.ReplaceAll(
+			fmt.Sprintf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String())),
+			u.glToken, "[REDACTED]"))
+	}
 	return nil
 }
 
+// git reports all failures with the same exit code so stderr is inspected instead
+// failures matching these are caused by credentials or a missing project and will not resolve on retry
+var permanentCloneFailures = []string{
+	"Authentication failed",
+	"could not read Username",
+	"not found",
+	"Permission denied",
+}
+
+func isPermanentCloneFailure(stderr string) bool {
+	for _, msg := range permanentCloneFailures {
+		if strings.Contains(stderr, msg) {
+			return true
+		}
+	}
+	return false
+}
+
 // returns git user-auth format of remote url
 func (u *Uploader) formatAuthURL(pid string) (string, error) {
 	projectURL := fmt.Sprintf("%s/%s", u.glBaseURL, pid)
@@ -0,0 +1,67 @@
+package pkg
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// metrics recorded from within the reconcile pipeline itself
+// run level metrics are recorded by the caller (see utils.RecordMetrics)
+var (
+	retryCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "git_partition_sync_producer_retries_total",
+			Help: "Increment by one for each retried attempt of an operation against GitLab, git, s3 or graphql",
+		},
+		[]string{
+			"operation",
+		},
+	)
+	retryExhaustedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "git_partition_sync_producer_retries_exhausted_total",
+			Help: "Increment by one each time an operation fails after its retry budget is exhausted",
+		},
+		[]string{
+			"operation",
+		},
+	)
+	secretFindingCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "git_partition_sync_producer_secret_scan_findings_total",
+			Help: "Increment by one for each secret scan finding that blocked a sync",
+		},
+		[]string{
+			"rule",
+		},
+	)
+	oversizedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "git_partition_sync_producer_oversized_syncs_total",
+			Help: "Increment by one each time a sync is skipped for exceeding its size limit. stage is source (gitlab statistics) or archive",
+		},
+		[]string{
+			"destination",
+			"stage",
+		},
+	)
+	reencryptPendingGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "git_partition_sync_producer_reencryption_pending",
+			Help: "Number of up to date s3 objects encrypted to a previous recipient set that exceeded the per run re-encryption limit",
+		},
+	)
+	configRefreshFailureCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "git_partition_sync_producer_config_refresh_failures_total",
+			Help: "Number of config refreshes that failed, leaving the last good config in use",
+		},
+	)
+)
+
+// register custom metrics at package import
+func init() {
+	prometheus.MustRegister(retryCounter)
+	prometheus.MustRegister(retryExhaustedCounter)
+	prometheus.MustRegister(secretFindingCounter)
+	prometheus.MustRegister(oversizedCounter)
+	prometheus.MustRegister(reencryptPendingGauge)
+	prometheus.MustRegister(configRefreshFailureCounter)
+}
@@ -0,0 +1,206 @@
+package pkg
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// sourceJob groups syncs that share a source project, branch and commit
+// the source is cloned once then packaged, encrypted and uploaded per destination
+type sourceJob struct {
+	pid      string
+	branch   string
+	commit   string
+	repoPath string
+	// committer timestamp of commit. set once cloned
+	committedAt time.Time
+	syncs       []*SyncConfig
+}
+
+// returns path relative to a working directory that is unique per source PID and branch
+// each value is path escaped into a single segment so nested groups cannot collide
+func (j *sourceJob) workspacePath() string {
+	return filepath.Join(url.PathEscape(j.pid), url.PathEscape(j.branch))
+}
+
+// groups out of sync configs by source ref. order of first occurrence is retained
+func groupBySource(toUpdate []*SyncConfig, glCommits refToCommit) []*sourceJob {
+	jobs := []*sourceJob{}
+	byRef := make(map[string]*sourceJob)
+	for _, gs := range toUpdate {
+		ref := gs.sourceRef()
+		job, exists := byRef[ref]
+		if !exists {
+			job = &sourceJob{
+				pid:    gs.sourcePid(),
+				branch: gs.Source.Branch,
+				commit: glCommits[ref],
+			}
+			byRef[ref] = job
+			jobs = append(jobs, job)
+		}
+		job.syncs = append(job.syncs, gs)
+	}
+	return jobs
+}
+
+// runs each job through clone, package and upload independently of other jobs
+// at most u.concurrency jobs are in flight, capping both throughput and peak disk usage
+// failures are recorded per sync within result and do not affect other jobs
+// once ctx is cancelled no further clones or uploads are started. uploads already in flight
+// are given u.gracePeriod to complete
+func (u *Uploader) processJobs(ctx context.Context, jobs []*sourceJob, recipients *recipientSet,
+	dryRun bool, result *RunResult) {
+
+	uploadCtx, cancel := withGracePeriod(ctx, u.gracePeriod)
+	defer cancel()
+
+	jobCh := make(chan *sourceJob)
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < u.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobCh {
+				u.processJob(ctx, uploadCtx, job, recipients, dryRun, result)
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		jobCh <- job
+	}
+	close(jobCh)
+
+	wg.Wait()
+}
+
+// checks size of job source, clones it, scans it for secrets when enabled, then uploads an artifact per destination
+// clone is removed once all destinations are processed to free disk for other jobs
+func (u *Uploader) processJob(ctx, uploadCtx context.Context, job *sourceJob, recipients *recipientSet,
+	dryRun bool, result *RunResult) {
+
+	if err := ctx.Err(); err != nil {
+		for _, gs := range job.syncs {
+			result.fail(gs, err)
+		}
+		return
+	}
+
+	// oversized sources are never cloned
+	syncs := u.checkSourceSize(ctx, job, job.syncs, result)
+	if len(syncs) == 0 {
+		return
+	}
+
+	if err := u.cloneRepo(ctx, job); err != nil {
+		for _, gs := range syncs {
+			result.fail(gs, err)
+		}
+		return
+	}
+	defer os.RemoveAll(job.repoPath)
+
+	if u.verifyArchives {
+		syncs = u.verifyHistory(ctx, job, syncs, result)
+	}
+
+	// syncs with findings are never packaged
+	if u.secretScanner != nil {
+		syncs = u.scanSecrets(ctx, job, syncs, result)
+	}
+
+	if dryRun {
+		// package artifacts without uploading to surface any tar or encryption errors
+		for _, gs := range syncs {
+			opts, err := u.archiveOptions(job, gs)
+			if err != nil {
+				result.fail(gs, err)
+				continue
+			}
+			digest, err := writeEncryptedTar(ctx, io.Discard, job.repoPath,
+				gs.encryptionRecipients(recipients).recipients, opts)
+			if err != nil {
+				countOversized(gs, "archive", err)
+				result.fail(gs, err)
+				continue
+			}
+			result.set(gs, SyncPlanned, digest)
+			// chunking is only decided by upload so the planned artifact is assumed to be a single object
+			if objKey, err := u.objectKey(gs, job.commit, gs.encryptionRecipients(recipients)); err == nil {
+				result.written(gs, []string{objKey})
+			}
+		}
+		return
+	}
+
+	for _, gs := range syncs {
+		// do not begin new uploads once shutdown is requested
+		err := ctx.Err()
+		if err != nil {
+			result.fail(gs, err)
+			continue
+		}
+
+		digest, keys, err := u.streamUpload(uploadCtx, job, gs, gs.encryptionRecipients(recipients))
+		if err != nil {
+			if len(keys) > 0 {
+				u.discardUnsigned(uploadCtx, keys, result.bySync[gs].staleKeys)
+			}
+			countOversized(gs, "archive", err)
+			result.fail(gs, err)
+			continue
+		}
+		result.set(gs, SyncUpdated, digest)
+		result.written(gs, keys)
+	}
+}
+
+// returns a context that is cancelled gracePeriod after parent is done
+// allows work that is already in flight to complete after shutdown is requested
+func withGracePeriod(parent context.Context, gracePeriod time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-parent.Done():
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-time.After(gracePeriod):
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// returns options for packaging the job clone for destination of gs
+// a new provenance manifest is started on each call so it must be called once per archive written
+func (u *Uploader) archiveOptions(job *sourceJob, gs *SyncConfig) (archiveOptions, error) {
+	mode, err := gs.exportMode()
+	if err != nil {
+		return archiveOptions{}, err
+	}
+	filter, err := gs.pathFilter()
+	if err != nil {
+		return archiveOptions{}, err
+	}
+	maxSize, err := u.sizeLimit(gs)
+	if err != nil {
+		return archiveOptions{}, err
+	}
+	return archiveOptions{
+		compression: u.compression,
+		provenance:  u.newProvenance(job, gs, mode, job.committedAt),
+		snapshot:    mode == MODE_SNAPSHOT,
+		filter:      filter,
+		maxSize:     maxSize,
+	}, nil
+}
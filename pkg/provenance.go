@@ -0,0 +1,106 @@
+package pkg
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"time"
+)
+
+const (
+	PRODUCER_NAME = "git-partition-sync-producer"
+	// directory within archives reserved for producer metadata
+	PROVENANCE_DIRECTORY = ".git-partition-sync"
+	PROVENANCE_FILE      = PROVENANCE_DIRECTORY + "/metadata.json"
+)
+
+// provenance is written to PROVENANCE_FILE as the final entry of each archive
+// it records where an artifact came from and digests of every packaged entry so the
+// consumer can audit and verify contents after decryption.
+// produced_at and config_bundle_sha differ between productions of the same commit, so archives are
+// not reproducible as a whole. content_sha256 is the digest that is
+type provenance struct {
+	Producer          string        `json:"producer"`
+	Instance          string        `json:"instance"`
+	ConfigBundleSHA   string        `json:"config_bundle_sha"`
+	SourcePid         string        `json:"source_pid"`
+	SourceBranch      string        `json:"source_branch"`
+	DestinationPid    string        `json:"destination_pid"`
+	DestinationBranch string        `json:"destination_branch"`
+	CommitSHA         string        `json:"commit_sha"`
+	Mode              string        `json:"mode"`
+	Include           []string      `json:"include,omitempty"`
+	Exclude           []string      `json:"exclude,omitempty"`
+	ProducedAt        time.Time     `json:"produced_at"`
+	CommittedAt       time.Time     `json:"committed_at"`
+	ContentSHA256     string        `json:"content_sha256"`
+	Entries           []entryDigest `json:"entries"`
+	// paths dropped by include/exclude. directories are listed once (trailing /) without their contents
+	Omitted []string `json:"omitted,omitempty"`
+
+	content hash.Hash
+}
+
+// entryDigest records a single packaged file or symlink
+// sha256 is of file contents, or of link target for symlinks
+type entryDigest struct {
+	Path   string `json:"path"`
+	Type   string `json:"type"`
+	Mode   int64  `json:"mode"`
+	SHA256 string `json:"sha256"`
+}
+
+// committedAt is the committer timestamp of the synced commit
+func (u *Uploader) newProvenance(job *sourceJob, gs *SyncConfig, mode string, committedAt time.Time) *provenance {
+	return &provenance{
+		Producer:          PRODUCER_NAME,
+		Instance:          u.instance,
+		ConfigBundleSHA:   u.bundleSha,
+		SourcePid:         job.pid,
+		SourceBranch:      job.branch,
+		DestinationPid:    gs.destinationPid(),
+		DestinationBranch: gs.Destination.Branch,
+		CommitSHA:         job.commit,
+		Mode:              mode,
+		Include:           gs.Include,
+		Exclude:           gs.Exclude,
+		ProducedAt:        time.Now().UTC(),
+		CommittedAt:       committedAt.UTC(),
+		Entries:           []entryDigest{},
+		content:           sha256.New(),
+	}
+}
+
+// records digest of a packaged entry. entries must be recorded in archive order
+func (p *provenance) record(header *tar.Header, digest []byte) {
+	entry := entryDigest{
+		Path:   header.Name,
+		Mode:   header.Mode,
+		SHA256: hex.EncodeToString(digest),
+	}
+	switch header.Typeflag {
+	case tar.TypeSymlink:
+		entry.Type = "symlink"
+	default:
+		entry.Type = "file"
+	}
+	p.Entries = append(p.Entries, entry)
+
+	// content digest covers entries only, so unlike produced_at and config bundle sha
+	// it is a pure function of the packaged commit
+	fmt.Fprintf(p.content, "%s %o %s %s\n", entry.Type, entry.Mode, entry.SHA256, entry.Path)
+}
+
+// records path omitted by filters
+func (p *provenance) omit(name string) {
+	p.Omitted = append(p.Omitted, name)
+}
+
+// returns manifest to be written as the final archive entry
+func (p *provenance) marshal() ([]byte, error) {
+	p.ContentSHA256 = hex.EncodeToString(p.content.Sum(nil))
+	return json.MarshalIndent(p, "", "  ")
+}
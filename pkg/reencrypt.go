@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// object metadata recording fingerprints of the recipient set an artifact is encrypted to
+const RECIPIENTS_METADATA = "recipients"
+
+// retrieves recipients of artifacts that are otherwise up to date and whose key has no recipients digest
+// listing objects does not return metadata so each candidate requires a head request.
+// artifacts uploaded prior to recipient fingerprints have none recorded and are treated as mismatched.
+// failed lookups are logged and leave Recipients nil, deferring the check to the next run
+func (u *Uploader) getRecipients(ctx context.Context, glCommits refToCommit, objInfos map[string]*s3ObjectInfo) {
+	candidates := []*s3ObjectInfo{}
+	for _, sync := range u.syncs {
+		objInfo, exists := objInfos[sync.destinationPid()]
+		if exists && objInfo.RecipientsDigest == "" && objInfo.Recipients == nil && objInfo.CommitSHA == glCommits[sync.sourceRef()] &&
+			u.packagedAsConfigured(sync, objInfo) {
+			candidates = append(candidates, objInfo)
+		}
+	}
+
+	ch := make(chan *s3ObjectInfo)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < u.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for objInfo := range ch {
+				var res *s3.HeadObjectOutput
+				err := retry(ctx, "s3_head_object", s3RetryPolicy, func(ctx context.Context) error {
+					ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*5)
+					defer cancel()
+
+					var err error
+					res, err = u.s3Client.HeadObject(ctxTimeout, &s3.HeadObjectInput{
+						Bucket: &u.bucket,
+						Key:    objInfo.Key,
+					})
+					return err
+				})
+				if err != nil {
+					log.Printf("Unable to retrieve recipients of s3 object `%s`: %v", *objInfo.Key, err)
+					continue
+				}
+				// absent metadata results in an empty set which never matches
+				recipients := res.Metadata[RECIPIENTS_METADATA]
+				objInfo.Recipients = &recipients
+			}
+		}()
+	}
+	for _, objInfo := range candidates {
+		ch <- objInfo
+	}
+	close(ch)
+	wg.Wait()
+}
+
+// returns true if recipients of objInfo differ from recipients
+// keys without a recipients digest are compared by metadata, if it was retrieved
+func (o *s3ObjectInfo) encryptedToOtherRecipients(recipients *recipientSet) bool {
+	if o.RecipientsDigest != "" {
+		return o.RecipientsDigest != recipients.digest()
+	}
+	return o.Recipients != nil && *o.Recipients != recipients.String()
+}
@@ -0,0 +1,121 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+)
+
+// loadedConfig is the config of a single run. it is replaced as a whole so a run never mixes
+// syncs of one load with recipients of another
+type loadedConfig struct {
+	syncs      []*SyncConfig
+	rejected   map[*SyncConfig]error
+	bundleSha  string
+	recipients *recipientSet
+}
+
+// loads syncs from the config source and recipients from the public key and public key file
+func (u *Uploader) loadConfig(ctx context.Context) (*loadedConfig, error) {
+	// recipients are validated before any repository is cloned so a bad key never fails a run midway
+	recipients, err := loadRecipients(u.publicKey, u.publicKeyFile, u.recipientPolicy.pins)
+	if err != nil {
+		return nil, err
+	}
+
+	syncs, bundleSha, err := u.configSource.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := ValidateConfig(syncs, u.recipientPolicy)
+	for _, issue := range report.Issues {
+		log.Printf("Config %s", issue)
+	}
+
+	return &loadedConfig{
+		syncs:      report.syncs,
+		rejected:   report.rejected,
+		bundleSha:  bundleSha,
+		recipients: recipients,
+	}, nil
+}
+
+func (u *Uploader) apply(cfg *loadedConfig) {
+	u.syncs = cfg.syncs
+	u.rejected = cfg.rejected
+	u.bundleSha = cfg.bundleSha
+	u.recipients = cfg.recipients
+}
+
+// Refresh reloads config between runs so changes apply without rebuilding clients
+// on failure the last good config is kept for the next run and the error is returned
+func (u *Uploader) Refresh(ctx context.Context) error {
+	cfg, err := u.loadConfig(ctx)
+	if err != nil {
+		configRefreshFailureCounter.Inc()
+		return fmt.Errorf("Unable to refresh config, keeping last good config: %v", err)
+	}
+	logConfigChanges(u.syncs, cfg.syncs)
+	if u.recipients.String() != cfg.recipients.String() {
+		log.Printf("Config refresh: recipients changed from [%s] to [%s]", u.recipients, cfg.recipients)
+	}
+	u.apply(cfg)
+	return nil
+}
+
+// logs syncs added, removed and changed between previous and current config
+// syncs are identified by source ref and destination. any other change is logged as changed
+func logConfigChanges(previous, current []*SyncConfig) {
+	before := make(map[string]*SyncConfig)
+	for _, gs := range previous {
+		before[gs.describe()] = gs
+	}
+	after := make(map[string]*SyncConfig)
+	for _, gs := range current {
+		after[gs.describe()] = gs
+	}
+
+	added, removed, changed := 0, 0, 0
+	for _, gs := range current {
+		old, exists := before[gs.describe()]
+		if !exists {
+			log.Printf("Config refresh: added sync %s", gs.describe())
+			added++
+		} else if changes := syncChanges(old, gs); len(changes) > 0 {
+			log.Printf("Config refresh: changed sync %s: %s", gs.describe(), strings.Join(changes, ", "))
+			changed++
+		}
+	}
+	for _, gs := range previous {
+		if _, exists := after[gs.describe()]; !exists {
+			log.Printf("Config refresh: removed sync %s", gs.describe())
+			removed++
+		}
+	}
+	if added+removed+changed > 0 {
+		log.Printf("Config refresh: %d added, %d removed, %d changed", added, removed, changed)
+	}
+}
+
+// returns descriptions of fields that differ between syncs with the same source and destination
+func syncChanges(old, new *SyncConfig) []string {
+	changes := []string{}
+	for _, field := range []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"mode", old.Mode, new.Mode},
+		{"include", old.Include, new.Include},
+		{"exclude", old.Exclude, new.Exclude},
+		{"maxSize", old.MaxSize, new.MaxSize},
+		{"recipient", old.Recipient, new.Recipient},
+	} {
+		if !reflect.DeepEqual(field.old, field.new) {
+			changes = append(changes, fmt.Sprintf("%s %q -> %q", field.name, field.old, field.new))
+		}
+	}
+	return changes
+}
@@ -0,0 +1,152 @@
+package pkg
+
+import (
+	"fmt"
+	"log"
+)
+
+// SyncStatus is the outcome of a single sync within a run
+type SyncStatus string
+
+const (
+	SyncUpToDate SyncStatus = "up_to_date"
+	SyncUpdated  SyncStatus = "updated"
+	SyncPlanned  SyncStatus = "planned" // dry run only; artifact was packaged but not uploaded
+	SyncFailed   SyncStatus = "failed"
+)
+
+// RunStatus summarizes the outcome of an entire run
+// values mirror those of the qontract_reconcile_last_run_status metric
+type RunStatus int
+
+const (
+	RunSuccess  RunStatus = 0
+	RunFailure  RunStatus = 1
+	RunDegraded RunStatus = 2 // run completed but at least one sync failed
+)
+
+// SyncResult records the outcome of a single sync
+type SyncResult struct {
+	SourcePid         string
+	SourceBranch      string
+	DestinationPid    string
+	DestinationBranch string
+	Status            SyncStatus
+	Err               error
+	// hex encoded SHA-256 of the unencrypted archive. set when packaged
+	ArchiveSHA256 string
+
+	// s3 keys of artifacts superseded by this sync
+	// only deleted once the replacement artifact is successfully uploaded
+	staleKeys []*string
+	// commit, mode and filters digest of the artifact superseded by this sync. empty if none exists
+	previousCommit  string
+	previousMode    string
+	previousFilters string
+	// keys of objects written by this sync. superseded keys that were overwritten in place
+	// (ex: re-encryption of an unchanged commit) are not deleted
+	writtenKeys []string
+}
+
+// RunResult records per sync outcomes of a run along with any deleted s3 object keys
+type RunResult struct {
+	Syncs   []*SyncResult
+	Deleted []string
+
+	bySync map[*SyncConfig]*SyncResult
+}
+
+func newRunResult(syncs []*SyncConfig) *RunResult {
+	r := &RunResult{
+		Syncs:  []*SyncResult{},
+		bySync: make(map[*SyncConfig]*SyncResult),
+	}
+	for _, gs := range syncs {
+		sr := &SyncResult{
+			SourcePid:         gs.sourcePid(),
+			SourceBranch:      gs.Source.Branch,
+			DestinationPid:    gs.destinationPid(),
+			DestinationBranch: gs.Destination.Branch,
+			Status:            SyncUpToDate,
+		}
+		r.Syncs = append(r.Syncs, sr)
+		r.bySync[gs] = sr
+	}
+	return r
+}
+
+// bySync is never written after construction, so distinct syncs may be updated concurrently
+func (r *RunResult) set(gs *SyncConfig, status SyncStatus, archiveSHA256 string) {
+	sr := r.bySync[gs]
+	sr.Status = status
+	sr.ArchiveSHA256 = archiveSHA256
+}
+
+func (r *RunResult) fail(gs *SyncConfig, err error) {
+	sr := r.bySync[gs]
+	sr.Status = SyncFailed
+	sr.Err = err
+	log.Printf("Sync of `%s` to `%s` failed: %v", sr.SourcePid, sr.DestinationPid, err)
+}
+
+func (r *RunResult) failed(gs *SyncConfig) bool {
+	return r.bySync[gs].Status == SyncFailed
+}
+
+// records objInfo as the artifact superseded by gs. it is deleted once gs is updated
+func (r *RunResult) supersede(gs *SyncConfig, objInfo *s3ObjectInfo) {
+	sr := r.bySync[gs]
+	sr.staleKeys = append(sr.staleKeys, objInfo.keys()...)
+	sr.previousCommit = objInfo.CommitSHA
+	sr.previousMode = objInfo.Mode
+	sr.previousFilters = objInfo.Filters
+}
+
+// records keys of objects written for gs
+func (r *RunResult) written(gs *SyncConfig, keys []string) {
+	r.bySync[gs].writtenKeys = keys
+}
+
+// returns superseded keys of syncs that were updated (or planned to be within a dry run)
+func (r *RunResult) staleKeys() []*string {
+	keys := []*string{}
+	for _, sr := range r.Syncs {
+		if sr.Status != SyncUpdated && sr.Status != SyncPlanned {
+			continue
+		}
+		written := make(map[string]bool)
+		for _, k := range sr.writtenKeys {
+			written[k] = true
+		}
+		for _, k := range sr.staleKeys {
+			if !written[*k] {
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys
+}
+
+// Failed returns results of all syncs that did not complete
+func (r *RunResult) Failed() []*SyncResult {
+	failed := []*SyncResult{}
+	for _, sr := range r.Syncs {
+		if sr.Status == SyncFailed {
+			failed = append(failed, sr)
+		}
+	}
+	return failed
+}
+
+// Status is RunDegraded if any sync failed, otherwise RunSuccess
+// hard failures are surfaced by Run as an error rather than through RunResult
+func (r *RunResult) Status() RunStatus {
+	if len(r.Failed()) > 0 {
+		return RunDegraded
+	}
+	return RunSuccess
+}
+
+func (r *RunResult) String() string {
+	return fmt.Sprintf("%d syncs, %d failed, %d objects deleted", len(r.Syncs), len(r.Failed()), len(r.Deleted))
+}
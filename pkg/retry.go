@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsretry "github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+	"github.com/xanzy/go-gitlab"
+)
+
+// retryPolicy bounds retries of a single operation
+// waits grow exponentially from base up to max with full jitter applied
+type retryPolicy struct {
+	attempts int           // total attempts including the first
+	base     time.Duration // upper bound of wait before second attempt
+	max      time.Duration // upper bound of any single wait
+	budget   time.Duration // total time across attempts and waits after which no further attempt is made
+}
+
+// per operation budgets. labels double as the operation label of retry metrics
+var (
+	graphqlRetryPolicy  = retryPolicy{attempts: 4, base: 1 * time.Second, max: 10 * time.Second, budget: 1 * time.Minute}
+	gitlabRetryPolicy   = retryPolicy{attempts: 4, base: 1 * time.Second, max: 15 * time.Second, budget: 1 * time.Minute}
+	cloneRetryPolicy    = retryPolicy{attempts: 3, base: 5 * time.Second, max: 30 * time.Second, budget: 10 * time.Minute}
+	s3RetryPolicy       = retryPolicy{attempts: 5, base: 500 * time.Millisecond, max: 10 * time.Second, budget: 1 * time.Minute}
+	s3UploadRetryPolicy = retryPolicy{attempts: 3, base: 2 * time.Second, max: 30 * time.Second, budget: 30 * time.Minute}
+)
+
+// math/rand is not safe for concurrent use outside of the global source
+var (
+	jitterMu  sync.Mutex
+	jitterRng = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// returns wait preceding the attempt following attempt n (zero indexed)
+func (p retryPolicy) backoff(n int) time.Duration {
+	ceiling := p.base << n
+	if ceiling <= 0 || ceiling > p.max {
+		// <= 0 guards against overflow of large shifts
+		ceiling = p.max
+	}
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return time.Duration(jitterRng.Int63n(int64(ceiling) + 1))
+}
+
+// executes fn until it succeeds, returns a non retryable error, or the policy is exhausted
+// the error of the final attempt is returned
+func retry(ctx context.Context, op string, policy retryPolicy, fn func(context.Context) error) error {
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || !isRetryable(ctx, err) {
+			return err
+		}
+
+		wait := policy.backoff(attempt)
+		if attempt+1 >= policy.attempts || time.Since(start)+wait > policy.budget {
+			retryExhaustedCounter.WithLabelValues(op).Inc()
+			return err
+		}
+
+		retryCounter.WithLabelValues(op).Inc()
+		log.Printf("%s failed (attempt %d/%d), retrying in %s: %v", op, attempt+1, policy.attempts, wait, err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// permanentError marks an error that must not be retried regardless of its underlying type
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// classifies errors of GitLab, s3 and git operations
+// errors of unknown type (network failures, git transport) are treated as transient
+func isRetryable(ctx context.Context, err error) bool {
+	// parent context cancelled or expired. further attempts are pointless
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var pErr *permanentError
+	if errors.As(err, &pErr) {
+		return false
+	}
+
+	// only rate limiting and server side errors of gitlab api are transient
+	var glErr *gitlab.ErrorResponse
+	if errors.As(err, &glErr) && glErr.Response != nil {
+		code := glErr.Response.StatusCode
+		return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+	}
+
+	// aws api errors are classified by the sdk (throttling, 5xx, transient connection errors)
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return awsretry.IsErrorRetryables(awsretry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary
+	}
+
+	return true
+}
@@ -2,75 +2,203 @@ package pkg
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"log"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/app-sre/git-partition-sync-producer/pkg/signature"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 type s3ObjectInfo struct {
-	Key       *string
-	CommitSHA string
+	Key         *string
+	CommitSHA   string
+	Compression string
+	Mode        string
+	Filters     string
+	// digest of recipient set recorded within key. empty for keys without one
+	RecipientsDigest string
+	// chunk objects of a chunked artifact, in which case Key is its index
+	Parts []*string
+	// detached signature of the artifact. nil if unsigned
+	Signature *string
+	// fingerprints the artifact is encrypted to, as recorded within its metadata
+	// nil when not retrieved. see getRecipients
+	Recipients *string
+	// time the artifact (or its index) was written
+	LastModified time.Time
+}
+
+// returns every object key of the artifact. index (or the artifact itself) is first
+func (o *s3ObjectInfo) keys() []*string {
+	keys := append([]*string{o.Key}, o.Parts...)
+	if o.Signature != nil {
+		keys = append(keys, o.Signature)
+	}
+	return keys
 }
 
 // processes response of ListObjectsV2 against aws api
-// return is map of destination PID to s3ObjectInfo
+// return is map of destination PID to s3ObjectInfo and keys of objects belonging to no current artifact:
+// chunks and signatures of no complete artifact (ex: upload interrupted before index was written) and
+// artifacts superseded by another of the same destination (ex: run interrupted before deleting them)
 // Context: within s3, our uploaded object keys are based64 encoded jsons
-func (u *Uploader) getS3Keys(ctx context.Context) (map[string]*s3ObjectInfo, error) {
-	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*5)
-	defer cancel()
-
-	res, err := u.s3Client.ListObjectsV2(ctxTimeout, &s3.ListObjectsV2Input{
+func (u *Uploader) getS3Keys(ctx context.Context) (map[string]*s3ObjectInfo, []*string, error) {
+	objects := []types.Object{}
+	paginator := s3.NewListObjectsV2Paginator(u.s3Client, &s3.ListObjectsV2Input{
 		Bucket: &u.bucket,
 	})
-	if err != nil {
-		return nil, err
+	for paginator.HasMorePages() {
+		var res *s3.ListObjectsV2Output
+		err := retry(ctx, "s3_list_objects", s3RetryPolicy, func(ctx context.Context) error {
+			ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*5)
+			defer cancel()
+
+			var err error
+			res, err = paginator.NextPage(ctxTimeout)
+			return err
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		objects = append(objects, res.Contents...)
 	}
 
-	s3ObjectInfos := make(map[string]*s3ObjectInfo)
-	for _, obj := range res.Contents {
+	// a destination has more than one artifact when superseded artifacts were not deleted
+	byDestination := make(map[string][]*s3ObjectInfo)
+	// chunked artifacts are identified by index. chunks and signatures are attached once all objects are known
+	artifacts := make(map[string]*s3ObjectInfo)
+	indexes := make(map[string]*s3ObjectInfo)
+	chunks := make(map[string][]*string)
+	signatures := make(map[string]*string)
+	for i := range objects {
+		obj := objects[i]
+		if strings.HasSuffix(*obj.Key, signature.SUFFIX) {
+			signatures[strings.TrimSuffix(*obj.Key, signature.SUFFIX)] = obj.Key
+			continue
+		}
+		artifact, isChunk, isIndex := splitChunkKey(*obj.Key)
+		if isChunk {
+			chunks[artifact] = append(chunks[artifact], obj.Key)
+			continue
+		}
+
 		// remove file extension before attempting decode
-		// extension is .tar.age, split at first occurrence of .
+		// extension is .tar[.gz|.zst].age[.index], split at first occurrence of .
 		encodedKey := strings.SplitN(*obj.Key, ".", 2)[0]
 		decodedBytes, err := base64.StdEncoding.DecodeString(encodedKey)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		var jsonKey DecodedKey
 		err = json.Unmarshal(decodedBytes, &jsonKey)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		pid := fmt.Sprintf("%s/%s", jsonKey.Group, jsonKey.ProjectName)
-		s3ObjectInfos[pid] = &s3ObjectInfo{
-			Key:       obj.Key,
-			CommitSHA: jsonKey.CommitSHA,
+		// fields absent within keys of objects uploaded prior to their introduction
+		compression := jsonKey.Compression
+		if compression == "" {
+			compression = CODEC_GZIP
+		}
+		mode := jsonKey.Mode
+		if mode == "" {
+			mode = MODE_HISTORY
+		}
+		info := &s3ObjectInfo{
+			Key:              obj.Key,
+			CommitSHA:        jsonKey.CommitSHA,
+			Compression:      compression,
+			Mode:             mode,
+			Filters:          jsonKey.Filters,
+			RecipientsDigest: jsonKey.Recipients,
+		}
+		if obj.LastModified != nil {
+			info.LastModified = *obj.LastModified
+		}
+		byDestination[pid] = append(byDestination[pid], info)
+		artifacts[artifact] = info
+		if isIndex {
+			indexes[artifact] = info
 		}
 	}
-	return s3ObjectInfos, nil
+
+	unreferenced := []*string{}
+	for artifact, keys := range chunks {
+		if info, exists := indexes[artifact]; exists {
+			info.Parts = keys
+		} else {
+			unreferenced = append(unreferenced, keys...)
+		}
+	}
+	for artifact, key := range signatures {
+		if info, exists := artifacts[artifact]; exists {
+			info.Signature = key
+		} else {
+			unreferenced = append(unreferenced, key)
+		}
+	}
+
+	s3ObjectInfos := make(map[string]*s3ObjectInfo)
+	for pid, infos := range byDestination {
+		current := infos[0]
+		for _, info := range infos[1:] {
+			if u.preferred(info, current) {
+				current = info
+			}
+		}
+		s3ObjectInfos[pid] = current
+		for _, info := range infos {
+			if info != current {
+				log.Printf("s3 object `%s` is superseded by `%s` of destination PID `%s`", *info.Key, *current.Key, pid)
+				unreferenced = append(unreferenced, info.keys()...)
+			}
+		}
+	}
+	return s3ObjectInfos, unreferenced, nil
+}
+
+// returns true if artifact a is preferred over b as the current artifact of their destination
+// signed artifacts are preferred when signing is enabled, then the most recently written
+func (u *Uploader) preferred(a, b *s3ObjectInfo) bool {
+	if u.signingKey != nil && (a.Signature != nil) != (b.Signature != nil) {
+		return a.Signature != nil
+	}
+	if !a.LastModified.Equal(b.LastModified) {
+		return a.LastModified.After(b.LastModified)
+	}
+	// keys are compared so the choice does not depend on listing order
+	return *a.Key > *b.Key
 }
 
 // concurrently deletes objects from s3 sync bucket that are no longer needed
 func (u *Uploader) removeOutdated(ctx context.Context, toDeleteKeys []*string) error {
-	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*5)
-	defer cancel()
-
 	wg := &sync.WaitGroup{}
-	ch := make(chan error)
+	ch := make(chan error, len(toDeleteKeys)) // buffered so goroutines never block after first error is returned
 
 	for _, key := range toDeleteKeys {
 		wg.Add(1)
 		go func(k *string) {
 			defer wg.Done()
 
-			_, err := u.s3Client.DeleteObject(ctxTimeout, &s3.DeleteObjectInput{
-				Bucket: &u.bucket,
-				Key:    k,
+			err := retry(ctx, "s3_delete_object", s3RetryPolicy, func(ctx context.Context) error {
+				ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*5)
+				defer cancel()
+
+				_, err := u.s3Client.DeleteObject(ctxTimeout, &s3.DeleteObjectInput{
+					Bucket: &u.bucket,
+					Key:    k,
+				})
+				return err
 			})
 			if err != nil {
 				ch <- err
@@ -92,70 +220,115 @@ func (u *Uploader) removeOutdated(ctx context.Context, toDeleteKeys []*string) e
 	return nil
 }
 
-// cocurrently uploads latest encrypted tars to target s3 bucket
-func (u *Uploader) uploadLatest(ctx context.Context, toUpdate []*SyncConfig, glCommits pidToCommit) error {
-	ctxTimeout, cancel := context.WithCancel(ctx)
-	defer cancel()
+// deletes objects of an artifact whose signature could not be written
+// otherwise it would remain beside the artifact it was to replace, leaving two artifacts for one destination.
+// keys shared with the replaced artifact (an unsigned artifact re-uploaded to be signed) are kept.
+// failures are only logged as objects left behind are deleted by a later run
+func (u *Uploader) discardUnsigned(ctx context.Context, keys []string, replaced []*string) {
+	shared := make(map[string]bool)
+	for _, k := range replaced {
+		shared[*k] = true
+	}
+	toDelete := []*string{}
+	for i := range keys {
+		if !shared[keys[i]] {
+			toDelete = append(toDelete, &keys[i])
+		}
+	}
+	if err := u.removeOutdated(ctx, toDelete); err != nil {
+		log.Printf("Unable to delete unsigned artifact: %v", err)
+	}
+}
 
-	wg := &sync.WaitGroup{}
-	ch := make(chan error)
-	// including sem due to following goroutines utilizing relatively expensive file io
-	sem := make(chan struct{}, 20) // arbitary value. TODO: evaluate resource consumption and adjust
+// returns s3 object key for latest artifact of a sync
+// key is base64 encoded json described by DecodedKey followed by archive extension
+func (u *Uploader) objectKey(gs *SyncConfig, commit string, recipients *recipientSet) (string, error) {
+	mode, err := gs.exportMode()
+	if err != nil {
+		return "", err
+	}
 
-	for _, gs := range toUpdate {
-		wg.Add(1)
-		sem <- struct{}{} // block if 20 goroutines already running
+	jsonStruct := &DecodedKey{
+		Group:        gs.Destination.Group,
+		ProjectName:  gs.Destination.ProjectName,
+		CommitSHA:    commit,
+		LocalBranch:  gs.Source.Branch,
+		RemoteBranch: gs.Destination.Branch,
+		Compression:  u.compression.codec,
+		Mode:         mode,
+		Filters:      filterDigest(gs.Include, gs.Exclude),
+		Recipients:   recipients.digest(),
+	}
 
-		go func(gsync *SyncConfig) {
-			defer func() { <-sem }() // release one from buffer
-			defer wg.Done()          // must exec before sem release
+	jsonBytes, err := json.Marshal(jsonStruct)
+	if err != nil {
+		return "", err
+	}
 
-			sourcePid := fmt.Sprintf("%s/%s", gsync.Source.Group, gsync.Source.ProjectName)
+	encodedJsonStr := base64.StdEncoding.EncodeToString(jsonBytes)
+	return fmt.Sprintf("%s%s.age", encodedJsonStr, u.compression.extension()), nil
+}
 
-			jsonStruct := &DecodedKey{
-				Group:        gsync.Destination.Group,
-				ProjectName:  gsync.Destination.ProjectName,
-				CommitSHA:    glCommits[sourcePid],
-				LocalBranch:  gsync.Source.Branch,
-				RemoteBranch: gsync.Destination.Branch,
-			}
+// returned to the packaging writer once its upload has failed
+var errUploadAborted = errors.New("upload aborted")
 
-			jsonBytes, err := json.Marshal(jsonStruct)
-			if err != nil {
-				ch <- err
-				return
-			}
+// uploads encrypted tar of job clone for destination of gs without staging the artifact on disk
+// artifact is re-packaged from the clone on each attempt
+// return is SHA-256 of the unencrypted archive (see writeEncryptedTar) and keys of objects written
+// if the artifact is written but its signature is not, keys of the unsigned artifact are returned with the error
+func (u *Uploader) streamUpload(ctx context.Context, job *sourceJob, gs *SyncConfig,
+	recipients *recipientSet) (string, []string, error) {
 
-			encodedJsonStr := base64.StdEncoding.EncodeToString(jsonBytes)
-			objKey := fmt.Sprintf("%s.tar.age", encodedJsonStr)
+	objKey, err := u.objectKey(gs, job.commit, recipients)
+	if err != nil {
+		return "", nil, err
+	}
 
-			f, err := os.Open(gsync.encryptPath)
-			defer f.Close()
+	var digest, encryptedDigest string
+	var keys []string
+	err = retry(ctx, "s3_upload", s3UploadRetryPolicy, func(ctx context.Context) error {
+		pr, pw := io.Pipe()
+		// digest of the artifact as published is signed
+		published := sha256.New()
+		packErr := make(chan error, 1)
+		go func() {
+			opts, err := u.archiveOptions(job, gs)
+			if err == nil {
+				digest, err = writeEncryptedTar(ctx, pw, job.repoPath, recipients.recipients, opts)
+			}
+			// closing with error (nil results in io.EOF) propagates packaging failures to the uploader
+			pw.CloseWithError(err)
+			packErr <- err
+		}()
 
-			_, err = u.s3Client.PutObject(ctxTimeout, &s3.PutObjectInput{
-				Bucket: &u.bucket,
-				Key:    &objKey,
-				Body:   f,
-			})
+		var err error
+		keys, err = u.putArtifact(ctx, objKey, io.TeeReader(pr, published), map[string]string{
+			"compression":       u.compression.String(),
+			RECIPIENTS_METADATA: recipients.String(),
+		})
+		if err != nil {
+			// unblock writer in the event upload failed before consuming entire stream
+			pr.CloseWithError(errUploadAborted)
+		}
 
-			if err != nil {
-				ch <- err
-				return
-			}
-		}(gs)
+		// packaging failures (unreadable files etc.) are not resolved by retrying
+		if pErr := <-packErr; pErr != nil && !errors.Is(pErr, errUploadAborted) {
+			return permanent(pErr)
+		}
+		encryptedDigest = hex.EncodeToString(published.Sum(nil))
+		return err
+	})
+	if err != nil {
+		return "", nil, err
 	}
 
-	go func() {
-		wg.Wait()
-		close(ch)
-		close(sem)
-	}()
-
-	for err := range ch {
+	// signature is written once the artifact is complete. an artifact without one is re-uploaded
+	if u.signingKey != nil {
+		sigKey, err := u.putSignature(ctx, objKey, encryptedDigest)
 		if err != nil {
-			return err
+			return "", keys, fmt.Errorf("Unable to sign artifact `%s`: %v", objKey, err)
 		}
+		keys = append(keys, sigKey)
 	}
-
-	return nil
+	return digest, keys, nil
 }
@@ -0,0 +1,192 @@
+package pkg
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/app-sre/git-partition-sync-producer/pkg/signature"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type listedObject struct {
+	Key          string
+	LastModified time.Time
+}
+
+// returns uploader whose s3 client lists objects from a fake bucket
+func newListingUploader(t *testing.T, objects []listedObject) *Uploader {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Query().Get("list-type") != "2" {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		xml.NewEncoder(w).Encode(struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []listedObject
+		}{Contents: objects})
+	}))
+	t.Cleanup(srv.Close)
+	client := s3.New(s3.Options{
+		Region:           "us-east-1",
+		EndpointResolver: s3.EndpointResolverFromURL(srv.URL),
+		UsePathStyle:     true,
+		Credentials:      aws.AnonymousCredentials{},
+	})
+	return &Uploader{bucket: "bucket", s3Client: client}
+}
+
+// returns artifact key of destination group/project at commit
+func testArtifactKey(t *testing.T, project, commit string) string {
+	t.Helper()
+	jsonBytes, err := json.Marshal(&DecodedKey{Group: "group", ProjectName: project, CommitSHA: commit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(jsonBytes) + ".tar.gz.age"
+}
+
+func derefKeys(keys []*string) []string {
+	out := []string{}
+	for _, k := range keys {
+		out = append(out, *k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestGetS3KeysSupersededArtifacts(t *testing.T) {
+	older := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	oldKey := testArtifactKey(t, "a", "old")
+	newKey := testArtifactKey(t, "a", "new")
+	otherKey := testArtifactKey(t, "b", "other")
+
+	tests := []struct {
+		name       string
+		signing    bool
+		objects    []listedObject
+		current    string
+		superseded []string
+	}{
+		{
+			name:       "newest artifact is current",
+			objects:    []listedObject{{newKey, newer}, {oldKey, older}, {otherKey, older}},
+			current:    newKey,
+			superseded: []string{oldKey},
+		},
+		{
+			name:       "listing order does not matter",
+			objects:    []listedObject{{oldKey, older}, {newKey, newer}, {otherKey, older}},
+			current:    newKey,
+			superseded: []string{oldKey},
+		},
+		{
+			name:       "superseded signature is removed with its artifact",
+			objects:    []listedObject{{oldKey, older}, {oldKey + ".sig", older}, {newKey, newer}, {otherKey, older}},
+			current:    newKey,
+			superseded: []string{oldKey, oldKey + ".sig"},
+		},
+		{
+			name:       "signed artifact is current when signing",
+			signing:    true,
+			objects:    []listedObject{{oldKey, older}, {oldKey + ".sig", older}, {newKey, newer}, {otherKey, older}},
+			current:    oldKey,
+			superseded: []string{newKey},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newListingUploader(t, tt.objects)
+			if tt.signing {
+				u.signingKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+			}
+			infos, unreferenced, err := u.getS3Keys(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(infos) != 2 {
+				t.Fatalf("got %d destinations, want 2", len(infos))
+			}
+			if got := *infos["group/a"].Key; got != tt.current {
+				t.Errorf("current artifact = %s, want %s", got, tt.current)
+			}
+			if got := *infos["group/b"].Key; got != otherKey {
+				t.Errorf("artifact of other destination = %s, want %s", got, otherKey)
+			}
+			sort.Strings(tt.superseded)
+			if got := derefKeys(unreferenced); !reflect.DeepEqual(got, tt.superseded) {
+				t.Errorf("unreferenced keys = %v, want %v", got, tt.superseded)
+			}
+		})
+	}
+}
+
+func TestGetS3KeysGroupsChunksAndSignatures(t *testing.T) {
+	modified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	chunked := testArtifactKey(t, "chunked", "commit")
+	single := testArtifactKey(t, "single", "commit")
+	interrupted := testArtifactKey(t, "interrupted", "commit")
+	unsigned := testArtifactKey(t, "unsigned", "commit")
+	gone := testArtifactKey(t, "gone", "commit")
+
+	objects := []listedObject{}
+	for _, key := range []string{
+		chunked + CHUNK_INDEX_SUFFIX, chunkKey(chunked, 1), chunkKey(chunked, 2), chunked + signature.SUFFIX,
+		single, single + signature.SUFFIX,
+		// upload interrupted before its index was written
+		chunkKey(interrupted, 1), chunkKey(interrupted, 2),
+		unsigned,
+		// signature whose artifact was deleted
+		gone + signature.SUFFIX,
+	} {
+		objects = append(objects, listedObject{key, modified})
+	}
+
+	infos, unreferenced, err := newListingUploader(t, objects).getS3Keys(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		"group/chunked":  {chunked + CHUNK_INDEX_SUFFIX, chunkKey(chunked, 1), chunkKey(chunked, 2), chunked + signature.SUFFIX},
+		"group/single":   {single, single + signature.SUFFIX},
+		"group/unsigned": {unsigned},
+	}
+	if len(infos) != len(want) {
+		t.Errorf("got %d destinations, want %d", len(infos), len(want))
+	}
+	for pid, keys := range want {
+		info, exists := infos[pid]
+		if !exists {
+			t.Errorf("no artifact for %s", pid)
+			continue
+		}
+		if got := *info.Key; got != keys[0] {
+			t.Errorf("key of %s = %s, want %s", pid, got, keys[0])
+		}
+		sort.Strings(keys)
+		if got := derefKeys(info.keys()); !reflect.DeepEqual(got, keys) {
+			t.Errorf("keys of %s = %v, want %v", pid, got, keys)
+		}
+	}
+	if infos["group/unsigned"].Signature != nil {
+		t.Error("unsigned artifact has signature")
+	}
+
+	wantUnreferenced := []string{chunkKey(interrupted, 1), chunkKey(interrupted, 2), gone + signature.SUFFIX}
+	sort.Strings(wantUnreferenced)
+	if got := derefKeys(unreferenced); !reflect.DeepEqual(got, wantUnreferenced) {
+		t.Errorf("unreferenced keys = %v, want %v", got, wantUnreferenced)
+	}
+}
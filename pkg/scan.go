@@ -0,0 +1,421 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// findings beyond this number are counted but not listed within a report
+const MAX_REPORTED_FINDINGS = 100
+
+// scanRule flags added lines matching regex
+type scanRule struct {
+	ID          string `yaml:"id"`
+	Description string `yaml:"description"`
+	Regex       string `yaml:"regex"`
+
+	re *regexp.Regexp
+}
+
+// scanConfig is the format of the rule file referenced by UploaderConfig.SecretScanRules
+// rules and allowed paths are appended to the builtin ones unless DisableBuiltinRules is set
+type scanConfig struct {
+	DisableBuiltinRules bool       `yaml:"disable_builtin_rules"`
+	Rules               []scanRule `yaml:"rules"`
+	Entropy             struct {
+		Disabled bool `yaml:"disabled"`
+		// minimum length of a token for it to be considered
+		MinLength int `yaml:"min_length"`
+		// shannon entropy (bits per character) at or above which a token is flagged
+		Threshold float64 `yaml:"threshold"`
+	} `yaml:"entropy"`
+	// glob patterns (see pathFilter) of paths that are never scanned
+	AllowPaths []string `yaml:"allow_paths"`
+	// fingerprints of reviewed findings that no longer block syncs
+	AllowFingerprints []string `yaml:"allow_fingerprints"`
+}
+
+var builtinScanRules = []scanRule{
+	{ID: "aws-access-key-id", Description: "AWS access key id", Regex: `\b(?:A3T[A-Z0-9]|AKIA|ASIA|ABIA|ACCA)[A-Z2-7]{16}\b`},
+	{ID: "private-key", Description: "PEM encoded private key", Regex: `-----BEGIN (?:[A-Z0-9]+ )?PRIVATE KEY(?: BLOCK)?-----`},
+	{ID: "age-secret-key", Description: "age identity", Regex: `\bAGE-SECRET-KEY-1[0-9A-Z]{58}\b`},
+	{ID: "gitlab-token", Description: "GitLab personal access token", Regex: `\bglpat-[0-9A-Za-z_\-]{20}\b`},
+	{ID: "github-token", Description: "GitHub token", Regex: `\bgh[pousr]_[0-9A-Za-z]{36,}\b`},
+	{ID: "slack-token", Description: "Slack token", Regex: `\bxox[abposr]-[0-9A-Za-z\-]{10,}`},
+	{ID: "google-api-key", Description: "Google API key", Regex: `\bAIza[0-9A-Za-z_\-]{35}\b`},
+	{ID: "jwt", Description: "JSON web token", Regex: `\beyJ[0-9A-Za-z_\-]{10,}\.eyJ[0-9A-Za-z_\-]{10,}\.[0-9A-Za-z_\-]{10,}`},
+}
+
+// lock files consist of high entropy checksums
+var builtinAllowPaths = []string{
+	"**/go.sum",
+	"**/package-lock.json",
+	"**/yarn.lock",
+	"**/Cargo.lock",
+	"**/Gemfile.lock",
+	"**/poetry.lock",
+	"**/composer.lock",
+}
+
+const (
+	ENTROPY_RULE_ID           = "high-entropy-string"
+	DEFAULT_ENTROPY_MIN_LEN   = 20
+	DEFAULT_ENTROPY_THRESHOLD = 4.5
+)
+
+// candidates for entropy checks. base64, base64url and hex alphabets
+var entropyTokenRegex = regexp.MustCompile(`[0-9A-Za-z+/=_\-]+`)
+
+// secretScanner checks lines added within a commit range for credentials
+type secretScanner struct {
+	rules             []scanRule
+	entropyMinLength  int
+	entropyThreshold  float64
+	allowPaths        *pathFilter
+	allowFingerprints map[string]bool
+}
+
+// finding is a single flagged line. the matched value itself is never recorded
+// fingerprint identifies the value so reviewed findings can be allowed
+type finding struct {
+	Rule        string `json:"rule"`
+	Commit      string `json:"commit"`
+	Path        string `json:"path"`
+	Line        int    `json:"line"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// returns scanner with builtin rules extended (or replaced) by those within rulesFile
+// rulesFile is yaml or json (see scanConfig). builtin rules are used as is when empty
+func newSecretScanner(rulesFile string) (*secretScanner, error) {
+	cfg := scanConfig{}
+	if rulesFile != "" {
+		raw, err := ioutil.ReadFile(rulesFile)
+		if err != nil {
+			return nil, err
+		}
+		// json is a subset of yaml
+		if err := yaml.Unmarshal(raw, &cfg); err != nil {
+			return nil, fmt.Errorf("Unable to parse secret scan rules %s: %v", rulesFile, err)
+		}
+	}
+
+	rules := cfg.Rules
+	allowPaths := cfg.AllowPaths
+	if !cfg.DisableBuiltinRules {
+		rules = append(append([]scanRule{}, builtinScanRules...), rules...)
+		allowPaths = append(append([]string{}, builtinAllowPaths...), allowPaths...)
+	}
+
+	s := &secretScanner{
+		entropyMinLength:  cfg.Entropy.MinLength,
+		entropyThreshold:  cfg.Entropy.Threshold,
+		allowFingerprints: make(map[string]bool),
+	}
+	for _, r := range rules {
+		if r.ID == "" || r.Regex == "" {
+			return nil, fmt.Errorf("Secret scan rule requires id and regex, got %+v", r)
+		}
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regex of secret scan rule %s: %v", r.ID, err)
+		}
+		r.re = re
+		s.rules = append(s.rules, r)
+	}
+	if cfg.Entropy.Disabled {
+		s.entropyMinLength = 0
+	} else {
+		if s.entropyMinLength <= 0 {
+			s.entropyMinLength = DEFAULT_ENTROPY_MIN_LEN
+		}
+		if s.entropyThreshold <= 0 {
+			s.entropyThreshold = DEFAULT_ENTROPY_THRESHOLD
+		}
+	}
+	filter, err := newPathFilter(nil, allowPaths)
+	if err != nil {
+		return nil, err
+	}
+	s.allowPaths = filter
+	for _, fp := range cfg.AllowFingerprints {
+		s.allowFingerprints[fp] = true
+	}
+	return s, nil
+}
+
+// scans lines added by commits of revs within repository at repoPath
+// revs are passed to git log as is (ex: `base..commit`). merge commits are not diffed;
+// their content is introduced by the commits being merged
+func (s *secretScanner) scanHistory(ctx context.Context, repoPath string, revs ...string) ([]finding, error) {
+	args := append([]string{"log", "-p", "--no-color", "--no-ext-diff", "--no-textconv", "--unified=0",
+		"--format=commit %H"}, revs...)
+	return s.scanGit(ctx, repoPath, "", args...)
+}
+
+// scans every line of files within the tree of commit, as packaged by snapshot syncs
+// the tree is diffed against the empty tree so its output is parsed like that of scanHistory
+func (s *secretScanner) scanTree(ctx context.Context, repoPath, commit string) ([]finding, error) {
+	// the empty tree id depends on the object format (sha1 or sha256) of the repository
+	cmd := exec.CommandContext(ctx, "git", "hash-object", "-t", "tree", "/dev/null")
+	cmd.Dir = repoPath
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git hash-object: %v", err)
+	}
+	emptyTree := strings.TrimSpace(string(out))
+	return s.scanGit(ctx, repoPath, commit, "diff", "--no-color", "--no-ext-diff", "--no-textconv",
+		"--unified=0", emptyTree, commit)
+}
+
+// runs git producing a patch within repoPath and scans its added lines
+// commit is attributed to findings until the output names one
+func (s *secretScanner) scanGit(ctx context.Context, repoPath, commit string, args ...string) ([]finding, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-c", "core.quotePath=off"}, args...)...)
+	cmd.Dir = repoPath
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	findings, parseErr := s.scanLog(bufio.NewReader(stdout), commit)
+	if parseErr != nil {
+		// drain so git is not blocked writing to a full pipe
+		io.Copy(io.Discard, stdout)
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return findings, parseErr
+}
+
+// parses output of git log -p --unified=0 (or git diff --unified=0) checking each added line
+// commit is attributed to findings until a `commit <sha>` line is read
+func (s *secretScanner) scanLog(r *bufio.Reader, commit string) ([]finding, error) {
+	findings := []finding{}
+	var path string
+	var lineNo int
+	inHunk := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		if len(line) > 0 {
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case strings.HasPrefix(line, "commit "):
+				commit = strings.TrimPrefix(line, "commit ")
+				inHunk = false
+			case strings.HasPrefix(line, "diff --git "):
+				path = ""
+				inHunk = false
+			case !inHunk && strings.HasPrefix(line, "+++ "):
+				// deleted files are compared against /dev/null and have no added lines
+				path = strings.TrimPrefix(strings.TrimPrefix(line, "+++ "), "b/")
+			case strings.HasPrefix(line, "@@ "):
+				inHunk = true
+				lineNo = hunkStart(line)
+			case inHunk && strings.HasPrefix(line, "+"):
+				if s.allowPaths == nil || s.allowPaths.keeps(path, false) {
+					findings = append(findings, s.scanLine(line[1:], commit, path, lineNo)...)
+				}
+				lineNo++
+			}
+		}
+		if err != nil {
+			return findings, nil
+		}
+	}
+}
+
+// returns first line number within new file of a hunk header `@@ -a,b +c,d @@`
+func hunkStart(header string) int {
+	fields := strings.Fields(header)
+	if len(fields) < 3 {
+		return 0
+	}
+	start, _ := strconv.Atoi(strings.SplitN(strings.TrimPrefix(fields[2], "+"), ",", 2)[0])
+	return start
+}
+
+func (s *secretScanner) scanLine(line, commit, path string, lineNo int) []finding {
+	findings := []finding{}
+	flag := func(rule, value string) {
+		digest := sha256.Sum256([]byte(value))
+		fp := hex.EncodeToString(digest[:8])
+		if s.allowFingerprints[fp] {
+			return
+		}
+		findings = append(findings, finding{
+			Rule:        rule,
+			Commit:      commit,
+			Path:        path,
+			Line:        lineNo,
+			Fingerprint: fp,
+		})
+	}
+
+	for _, r := range s.rules {
+		for _, match := range r.re.FindAllString(line, -1) {
+			flag(r.ID, match)
+		}
+	}
+	if s.entropyMinLength > 0 {
+		for _, token := range entropyTokenRegex.FindAllString(line, -1) {
+			if len(token) >= s.entropyMinLength && shannonEntropy(token) >= s.entropyThreshold {
+				flag(ENTROPY_RULE_ID, token)
+			}
+		}
+	}
+	return findings
+}
+
+// returns shannon entropy of s in bits per character
+func shannonEntropy(s string) float64 {
+	counts := make(map[rune]int)
+	for _, c := range s {
+		counts[c]++
+	}
+	entropy := 0.0
+	n := float64(len(s))
+	for _, count := range counts {
+		p := float64(count) / n
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// scans content each of syncs would publish. syncs with findings are failed within result
+// and a sanitized report is logged. return is syncs that passed
+//
+// snapshot syncs only publish the tree at the job commit, so that tree is scanned and a credential
+// removed from history does not block them. history syncs publish every commit, so commits from
+// that of the sync's current artifact to the job commit are scanned. their entire history is
+// scanned when new, when the current artifact is a snapshot, or when the current commit is not an
+// ancestor (ex: force push). scanning is only skipped when the published content is unchanged, i.e.
+// the current artifact has the same commit, mode and filters. findings within paths a sync's filters omit are ignored
+func (u *Uploader) scanSecrets(ctx context.Context, job *sourceJob, syncs []*SyncConfig, result *RunResult) []*SyncConfig {
+	passed := []*SyncConfig{}
+	// syncs of a job usually share a base commit so each range (or the tree) is scanned once
+	scanned := make(map[string][]finding)
+	for _, gs := range syncs {
+		previous := result.bySync[gs]
+		base := previous.previousCommit
+		mode, _ := gs.exportMode()
+		if base == job.commit && previous.previousMode == mode &&
+			previous.previousFilters == filterDigest(gs.Include, gs.Exclude) {
+			// content was published before. only packaging changed (ex: re-encryption or codec)
+			passed = append(passed, gs)
+			continue
+		}
+		// history preceding the commit of a snapshot was never published, so it was never scanned
+		if previous.previousMode != MODE_HISTORY || base == job.commit {
+			base = ""
+		}
+
+		// previous commit does not bound the content of a snapshot. cache keys of history ranges
+		// are base commits, which cannot collide with the mode name
+		snapshot := mode == MODE_SNAPSHOT
+		cacheKey := base
+		if snapshot {
+			base = ""
+			cacheKey = MODE_SNAPSHOT
+		}
+
+		findings, exists := scanned[cacheKey]
+		if !exists {
+			var err error
+			if snapshot {
+				findings, err = u.secretScanner.scanTree(ctx, job.repoPath, job.commit)
+			} else {
+				findings, err = u.secretScanner.scanHistory(ctx, job.repoPath, u.scanRange(ctx, job, base)...)
+			}
+			if err != nil {
+				result.fail(gs, fmt.Errorf("Secret scan failed: %v", err))
+				continue
+			}
+			scanned[cacheKey] = findings
+		}
+
+		if filter, err := gs.pathFilter(); err == nil && filter != nil {
+			kept := []finding{}
+			for _, f := range findings {
+				if filter.keeps(f.Path, false) {
+					kept = append(kept, f)
+				}
+			}
+			findings = kept
+		}
+
+		if len(findings) > 0 {
+			for _, f := range findings {
+				secretFindingCounter.WithLabelValues(f.Rule).Inc()
+			}
+			logScanReport(job, gs, base, findings)
+			result.fail(gs, fmt.Errorf("Secret scan blocked publishing of %s: %d findings", job.commit, len(findings)))
+			continue
+		}
+		passed = append(passed, gs)
+	}
+	return passed
+}
+
+// returns git log revisions of commits to scan from base to job commit
+func (u *Uploader) scanRange(ctx context.Context, job *sourceJob, base string) []string {
+	if base != "" && u.git(ctx, job.repoPath, "merge-base", "--is-ancestor", base, job.commit) == nil {
+		return []string{fmt.Sprintf("%s..%s", base, job.commit)}
+	}
+	return []string{job.commit}
+}
+
+// report only identifies where findings are. flagged values are never logged
+func logScanReport(job *sourceJob, gs *SyncConfig, base string, findings []finding) {
+	report := struct {
+		SourcePid      string    `json:"source_pid"`
+		SourceBranch   string    `json:"source_branch"`
+		DestinationPid string    `json:"destination_pid"`
+		FromCommit     string    `json:"from_commit,omitempty"`
+		ToCommit       string    `json:"to_commit"`
+		Total          int       `json:"total"`
+		Findings       []finding `json:"findings"`
+	}{
+		SourcePid:      job.pid,
+		SourceBranch:   job.branch,
+		DestinationPid: gs.destinationPid(),
+		FromCommit:     base,
+		ToCommit:       job.commit,
+		Total:          len(findings),
+		Findings:       findings,
+	}
+	if len(findings) > MAX_REPORTED_FINDINGS {
+		report.Findings = findings[:MAX_REPORTED_FINDINGS]
+	}
+	out, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("Unable to marshal secret scan report: %v", err)
+		return
+	}
+	log.Printf("Secret scan report: %s", out)
+}
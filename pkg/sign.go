@@ -0,0 +1,37 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/app-sre/git-partition-sync-producer/pkg/signature"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// uploads detached signature of artifact objKey with encrypted digest sha256Hex
+// return is key of the signature object
+func (u *Uploader) putSignature(ctx context.Context, objKey, sha256Hex string) (string, error) {
+	body, err := signature.Sign(u.signingKey, objKey, sha256Hex).Marshal()
+	if err != nil {
+		return "", err
+	}
+	sigKey := objKey + signature.SUFFIX
+	contentType := "application/json"
+	err = retry(ctx, "s3_put_signature", s3RetryPolicy, func(ctx context.Context) error {
+		ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*5)
+		defer cancel()
+
+		_, err := u.s3Client.PutObject(ctxTimeout, &s3.PutObjectInput{
+			Bucket:      &u.bucket,
+			Key:         &sigKey,
+			Body:        bytes.NewReader(body),
+			ContentType: &contentType,
+		})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return sigKey, nil
+}
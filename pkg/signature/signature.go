@@ -0,0 +1,141 @@
+// Package signature signs and verifies artifacts published by the producer
+// age provides confidentiality only. signatures prove an artifact was published by the producer
+// holding the signing key and that it was not moved to a different object key
+//
+// it has no dependencies on the rest of the producer so consumers may import it to verify artifacts
+package signature
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// detached signature of an artifact is published as <artifact key>.sig
+	SUFFIX = ".sig"
+
+	VERSION   = 1
+	ALGORITHM = "ed25519"
+)
+
+// Signature is the content of a detached signature object
+type Signature struct {
+	Version   int    `json:"version"`
+	Algorithm string `json:"algorithm"`
+	// identifies the public key required to verify. see KeyID
+	KeyID string `json:"key_id"`
+	// hex encoded SHA-256 of the artifact as published (encrypted). for chunked artifacts
+	// it is of the concatenated chunks
+	SHA256 string `json:"sha256"`
+	// base64 encoded ed25519 signature of the statement (see statement)
+	Value string `json:"signature"`
+}
+
+// returns signed message. binding the object key prevents a valid artifact from being
+// replayed under the key of another project or commit
+func statement(objectKey, sha256Hex string) []byte {
+	return []byte(fmt.Sprintf("git-partition-sync-producer signature v%d\nkey: %s\nsha256: %s\n",
+		VERSION, objectKey, sha256Hex))
+}
+
+// ParsePrivateKey parses a PEM encoded PKCS #8 ed25519 private key
+// ex: openssl genpkey -algorithm ed25519
+func ParsePrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("Signing key is not PEM encoded")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Signing key must be ed25519, got %T", key)
+	}
+	return edKey, nil
+}
+
+// ParsePublicKey parses a PEM encoded PKIX ed25519 public key
+// ex: openssl pkey -in private.pem -pubout
+func ParsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("Public key is not PEM encoded")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Public key must be ed25519, got %T", key)
+	}
+	return edKey, nil
+}
+
+// KeyID returns the first 8 bytes (hex encoded) of the SHA-256 of the raw public key
+func KeyID(key ed25519.PublicKey) string {
+	digest := sha256.Sum256(key)
+	return hex.EncodeToString(digest[:8])
+}
+
+// Sign returns signature of the artifact published as objectKey with digest sha256Hex
+func Sign(key ed25519.PrivateKey, objectKey, sha256Hex string) *Signature {
+	return &Signature{
+		Version:   VERSION,
+		Algorithm: ALGORITHM,
+		KeyID:     KeyID(key.Public().(ed25519.PublicKey)),
+		SHA256:    sha256Hex,
+		Value:     base64.StdEncoding.EncodeToString(ed25519.Sign(key, statement(objectKey, sha256Hex))),
+	}
+}
+
+// Marshal returns the content of the detached signature object
+func (s *Signature) Marshal() ([]byte, error) {
+	return json.MarshalIndent(s, "", "  ")
+}
+
+// Parse parses the content of a detached signature object
+func Parse(data []byte) (*Signature, error) {
+	var s Signature
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("Malformed signature: %v", err)
+	}
+	if s.Version != VERSION || s.Algorithm != ALGORITHM {
+		return nil, fmt.Errorf("Unsupported signature version %d algorithm %q", s.Version, s.Algorithm)
+	}
+	return &s, nil
+}
+
+// Verify checks that artifact, read to its end, was signed by key and published as objectKey
+// artifact must only be decrypted once Verify returns nil
+func Verify(key ed25519.PublicKey, objectKey string, artifact io.Reader, s *Signature) error {
+	if s.KeyID != KeyID(key) {
+		return fmt.Errorf("Signature is by key %s, expected %s", s.KeyID, KeyID(key))
+	}
+	value, err := base64.StdEncoding.DecodeString(s.Value)
+	if err != nil {
+		return fmt.Errorf("Malformed signature value: %v", err)
+	}
+	if !ed25519.Verify(key, statement(objectKey, s.SHA256), value) {
+		return errors.New("Invalid signature")
+	}
+
+	digest := sha256.New()
+	if _, err := io.Copy(digest, artifact); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(digest.Sum(nil)); actual != s.SHA256 {
+		return fmt.Errorf("Artifact sha256 %s does not match signed sha256 %s", actual, s.SHA256)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package signature
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+const testObjectKey = "eyJncm91cCI6Imdyb3VwIn0=.tar.gz.age"
+
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// signs artifact as the producer does and returns the published signature object
+func signArtifact(t *testing.T, key ed25519.PrivateKey, objectKey string, artifact []byte) []byte {
+	t.Helper()
+	digest := sha256.Sum256(artifact)
+	data, err := Sign(key, objectKey, hex.EncodeToString(digest[:])).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := newTestKey(t)
+	artifact := []byte("encrypted artifact")
+
+	s, err := Parse(signArtifact(t, key, testObjectKey, artifact))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Verify(key.Public().(ed25519.PublicKey), testObjectKey, bytes.NewReader(artifact), s)
+	if err != nil {
+		t.Errorf("Verify of untampered artifact failed: %v", err)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	key := newTestKey(t)
+	otherKey := newTestKey(t)
+	artifact := []byte("encrypted artifact")
+	signed := signArtifact(t, key, testObjectKey, artifact)
+
+	tests := []struct {
+		name      string
+		key       ed25519.PublicKey
+		objectKey string
+		artifact  []byte
+		// alters parsed signature before verification
+		alter func(s *Signature)
+		err   string
+	}{
+		{
+			name:     "tampered artifact",
+			artifact: []byte("encrypted artifacT"),
+			err:      "does not match signed sha256",
+		},
+		{
+			name:     "truncated artifact",
+			artifact: artifact[:len(artifact)-1],
+			err:      "does not match signed sha256",
+		},
+		{
+			name:      "replayed under other object key",
+			objectKey: "eyJncm91cCI6Im90aGVyIn0=.tar.gz.age",
+			err:       "Invalid signature",
+		},
+		{
+			name: "other public key",
+			key:  otherKey.Public().(ed25519.PublicKey),
+			err:  "Signature is by key",
+		},
+		{
+			name: "key id of expected key on signature by other key",
+			key:  otherKey.Public().(ed25519.PublicKey),
+			alter: func(s *Signature) {
+				s.KeyID = KeyID(otherKey.Public().(ed25519.PublicKey))
+			},
+			err: "Invalid signature",
+		},
+		{
+			name: "signed digest replaced",
+			alter: func(s *Signature) {
+				digest := sha256.Sum256([]byte("other artifact"))
+				s.SHA256 = hex.EncodeToString(digest[:])
+			},
+			err: "Invalid signature",
+		},
+		{
+			name: "malformed value",
+			alter: func(s *Signature) {
+				s.Value = "not base64!"
+			},
+			err: "Malformed signature value",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.alter != nil {
+				tt.alter(s)
+			}
+			pub := key.Public().(ed25519.PublicKey)
+			if tt.key != nil {
+				pub = tt.key
+			}
+			objectKey := testObjectKey
+			if tt.objectKey != "" {
+				objectKey = tt.objectKey
+			}
+			data := artifact
+			if tt.artifact != nil {
+				data = tt.artifact
+			}
+
+			err = Verify(pub, objectKey, bytes.NewReader(data), s)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Verify error = %v, want error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	tests := map[string]string{
+		"malformed json":      `{"version": 1,`,
+		"unsupported version": `{"version": 2, "algorithm": "ed25519"}`,
+		"unsupported algo":    `{"version": 1, "algorithm": "rsa"}`,
+		"empty":               ``,
+	}
+	for name, data := range tests {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("Parse accepted %s", name)
+		}
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	key := newTestKey(t)
+	privDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	priv, err := ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !priv.Equal(key) || !pub.Equal(key.Public()) {
+		t.Error("parsed keys differ from generated key")
+	}
+
+	if _, err := ParsePrivateKey([]byte("not pem")); err == nil {
+		t.Error("ParsePrivateKey accepted data without PEM block")
+	}
+	if _, err := ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})); err == nil {
+		t.Error("ParsePublicKey accepted private key")
+	}
+}
@@ -0,0 +1,162 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// suffixes accepted by parseSize. decimal and binary units mirror kubernetes quantities
+var sizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"Ki", 1 << 10},
+	{"Mi", 1 << 20},
+	{"Gi", 1 << 30},
+	{"Ti", 1 << 40},
+	{"K", 1e3},
+	{"M", 1e6},
+	{"G", 1e9},
+	{"T", 1e12},
+}
+
+// parses size in bytes with an optional unit suffix (ex: 500Mi, 2G). empty is 0 (no limit)
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	value := s
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			multiplier = unit.multiplier
+			value = strings.TrimSuffix(s, unit.suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size %q. must be a non negative number of bytes with optional suffix Ki, Mi, Gi, Ti, K, M, G or T", s)
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("Invalid size %q. exceeds maximum of %d bytes", s, int64(math.MaxInt64))
+	}
+	return n * multiplier, nil
+}
+
+// returns human readable size in binary units
+func formatSize(n int64) string {
+	const unit = 1 << 10
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGT"[exp])
+}
+
+// returns size limit in bytes of clone and artifact of gs. 0 if unlimited
+// a per sync limit can only lower the global limit, which protects the shared working volume
+func (u *Uploader) sizeLimit(gs *SyncConfig) (int64, error) {
+	limit, err := parseSize(gs.MaxSize)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid maxSize of sync to %s: %v", gs.destinationPid(), err)
+	}
+	if limit == 0 || (u.maxSize > 0 && u.maxSize < limit) {
+		return u.maxSize, nil
+	}
+	return limit, nil
+}
+
+var errSizeLimitExceeded = errors.New("size limit exceeded")
+
+// limitWriter fails writes once more than limit bytes are written to w
+type limitWriter struct {
+	w       io.Writer
+	limit   int64
+	written int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.written+int64(len(p)) > l.limit {
+		return 0, fmt.Errorf("Artifact exceeds %s: %w", formatSize(l.limit), errSizeLimitExceeded)
+	}
+	n, err := l.w.Write(p)
+	l.written += int64(n)
+	return n, err
+}
+
+// counts failure of gs if it was caused by its size limit
+// stage is source (pre-clone statistics) or archive
+func countOversized(gs *SyncConfig, stage string, err error) {
+	if errors.Is(err, errSizeLimitExceeded) {
+		oversizedCounter.WithLabelValues(gs.destinationPid(), stage).Inc()
+	}
+}
+
+// checks repository size reported by gitlab project statistics against limits of job syncs
+// before cloning. syncs whose limit is exceeded are failed within result. return is syncs within limits
+// statistics require reporter access to the source project; the check is skipped when they are
+// unavailable and limits are then only enforced against the archive
+func (u *Uploader) checkSourceSize(ctx context.Context, job *sourceJob, syncs []*SyncConfig,
+	result *RunResult) []*SyncConfig {
+
+	limits := make(map[*SyncConfig]int64)
+	limited := false
+	passed := []*SyncConfig{}
+	for _, gs := range syncs {
+		limit, err := u.sizeLimit(gs)
+		if err != nil {
+			result.fail(gs, err)
+			continue
+		}
+		limits[gs] = limit
+		limited = limited || limit > 0
+		passed = append(passed, gs)
+	}
+	if !limited {
+		return passed
+	}
+
+	var project *gitlab.Project
+	err := retry(ctx, "gitlab_get_project", gitlabRetryPolicy, func(ctx context.Context) error {
+		var err error
+		project, _, err = u.glClient.Projects.GetProject(job.pid,
+			&gitlab.GetProjectOptions{Statistics: gitlab.Bool(true)}, gitlab.WithContext(ctx))
+		return err
+	})
+	if err != nil {
+		log.Printf("Unable to retrieve statistics of %s, skipping pre-clone size check: %v", job.pid, err)
+		return passed
+	}
+	if project.Statistics == nil {
+		log.Printf("Statistics of %s unavailable, skipping pre-clone size check", job.pid)
+		return passed
+	}
+
+	// the single branch clone may be smaller than the whole repository, so this is conservative
+	size := project.Statistics.RepositorySize
+	within := []*SyncConfig{}
+	for _, gs := range passed {
+		if limit := limits[gs]; limit > 0 && size > limit {
+			err := fmt.Errorf("Source repository %s is %s, exceeding size limit of %s: %w",
+				job.pid, formatSize(size), formatSize(limit), errSizeLimitExceeded)
+			countOversized(gs, "source", err)
+			result.fail(gs, err)
+			continue
+		}
+		within = append(within, gs)
+	}
+	return within
+}
@@ -2,89 +2,294 @@ package pkg
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
-const TAR_DIRECTORY = "tars"
+// modification time of every archive entry
+// fixed so that archives of the same commit are byte for byte identical
+var archiveModTime = time.Unix(0, 0)
 
-func (u *Uploader) tarRepos(toUpdate []*SyncConfig) error {
-	err := u.clean(TAR_DIRECTORY)
+// files git rewrites with clone specific state (stat data, timestamps, previous HEAD)
+// none are required to push the packaged repository and all would make archives non deterministic.
+// the index can be rebuilt by the consumer with `git reset`
+var volatileGitPaths = []string{
+	".git/index",
+	".git/logs",
+	".git/ORIG_HEAD",
+	".git/FETCH_HEAD",
+	// server info and commit graph. not required by push
+	".git/objects/info",
+}
+
+// archiveOptions control packaging of a single artifact
+type archiveOptions struct {
+	compression compression
+	// when set, digests of each entry are recorded and the manifest is appended as the final entry
+	provenance *provenance
+	// when set, only the checked out tree is packaged. git history (.git) is omitted
+	snapshot bool
+	// when set, only paths it keeps are packaged. never applied to .git
+	filter *pathFilter
+	// packaging fails once the encrypted artifact exceeds this many bytes. 0 is unlimited
+	maxSize int64
+}
+
+// streams a tar of repoPath compressed with opts.compression to w
+// nothing is written to disk; callers are expected to chain w into encryption and upload
+// packaging is abandoned between files once ctx is done
+//
+// directories, symlinks and regular files (including executable bit) are preserved
+// repository entries of a pinned clone (repacked when history is packaged, see repackClone) are deterministic:
+// they are written in lexical order (guaranteed by filepath.Walk), headers carry no timestamps,
+// ownership or platform specific fields and compression is deterministic.
+// the provenance manifest (when requested) is not, as it records production time
+func writeTar(ctx context.Context, w io.Writer, repoPath string, opts archiveOptions) error {
+	// ensure the repo actually exists before trying to tar it
+	if _, err := os.Stat(repoPath); err != nil {
+		return fmt.Errorf("Unable to tar files - %v", err.Error())
+	}
+
+	cw, err := opts.compression.newWriter(w)
 	if err != nil {
 		return err
 	}
+	tw := tar.NewWriter(cw)
 
-	for _, gs := range toUpdate {
-		// ensure the repo actually exists before trying to tar it
-		if _, err := os.Stat(gs.repoPath); err != nil {
-			return fmt.Errorf("Unable to tar files - %v", err.Error())
-		}
-
-		tarPath := fmt.Sprintf("%s/%s/%s.tar", u.workdir, TAR_DIRECTORY, gs.Source.ProjectName)
-		f, err := os.Create(tarPath)
+	// credit: https://medium.com/@skdomino/taring-untaring-files-in-go-6b07cf56bc07
+	err = filepath.Walk(repoPath, func(file string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		defer f.Close()
-
-		gzw := gzip.NewWriter(f)
-		defer gzw.Close()
-
-		tw := tar.NewWriter(gzw)
-		defer tw.Close()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-		// credit: https://medium.com/@skdomino/taring-untaring-files-in-go-6b07cf56bc07
-		err = filepath.Walk(gs.repoPath, func(file string, fi os.FileInfo, err error) error {
-			if err != nil {
-				return err
+		// update the name to correctly reflect the desired destination when untaring
+		name := filepath.ToSlash(strings.TrimPrefix(strings.Replace(file, repoPath, "", -1), string(filepath.Separator)))
+		if opts.snapshot && name == ".git" {
+			return filepath.SkipDir
+		}
+		if isVolatileGitPath(name) {
+			if fi.IsDir() {
+				return filepath.SkipDir
 			}
-
-			if !fi.Mode().IsRegular() {
-				return nil
+			return nil
+		}
+		if opts.provenance != nil && (name == PROVENANCE_DIRECTORY || strings.HasPrefix(name, PROVENANCE_DIRECTORY+"/")) {
+			return fmt.Errorf("Repository contains path %q reserved for provenance manifest", name)
+		}
+		if opts.filter != nil && name != "" && !opts.filter.keeps(name, fi.IsDir()) {
+			if fi.IsDir() {
+				if opts.provenance != nil {
+					opts.provenance.omit(name + "/")
+				}
+				return filepath.SkipDir
 			}
-
-			// create a new dir/file header
-			header, err := tar.FileInfoHeader(fi, fi.Name())
-			if err != nil {
-				return err
+			if opts.provenance != nil {
+				opts.provenance.omit(name)
 			}
+			return nil
+		}
 
-			// update the name to correctly reflect the desired destination when untaring
-			header.Name = strings.TrimPrefix(strings.Replace(file, gs.repoPath, "", -1), string(filepath.Separator))
+		// create a new header. only content dependent fields are populated
+		header := &tar.Header{
+			Name:    name,
+			ModTime: archiveModTime,
+			Format:  tar.FormatPAX,
+		}
 
-			// write the header
-			if err := tw.WriteHeader(header); err != nil {
-				return err
+		switch mode := fi.Mode(); {
+		case mode.IsDir():
+			if name == "" {
+				// repository root itself
+				return nil
 			}
-
-			// open files for taring
-			f, err := os.Open(file)
+			// directory entries preserve directories that would otherwise be empty
+			header.Typeflag = tar.TypeDir
+			header.Name += "/"
+			header.Mode = 0755
+		case mode&os.ModeSymlink != 0:
+			// links are stored as is and never followed
+			target, err := os.Readlink(file)
 			if err != nil {
 				return err
 			}
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = target
+			header.Mode = 0777
+		case mode.IsRegular():
+			header.Typeflag = tar.TypeReg
+			header.Size = fi.Size()
+			header.Mode = normalizedMode(mode)
+		default:
+			// sockets, devices and pipes have no representation within git
+			return nil
+		}
 
-			// copy file data into tar writer
-			if _, err := io.Copy(tw, f); err != nil {
-				return err
-			}
+		// write the header
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeSymlink && opts.provenance != nil {
+			digest := sha256.Sum256([]byte(header.Linkname))
+			opts.provenance.record(header, digest[:])
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
 
-			// manually close here after each file operation; defering would cause each file close
-			// to wait until all operations have completed.
+		// open files for taring
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+
+		// copy file data into tar writer
+		digest := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(tw, digest), f); err != nil {
 			f.Close()
+			return err
+		}
 
-			return nil
-		})
+		// manually close here after each file operation; defering would cause each file close
+		// to wait until all operations have completed.
+		f.Close()
+
+		if opts.provenance != nil {
+			opts.provenance.record(header, digest.Sum(nil))
+		}
 
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if opts.provenance != nil {
+		if err := writeProvenance(tw, opts.provenance); err != nil {
+			return err
+		}
+	}
+
+	// writers must be closed in order to flush tar footer and compression trailer
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// appends provenance manifest and its parent directory to tw
+func writeProvenance(tw *tar.Writer, p *provenance) error {
+	manifest, err := p.marshal()
+	if err != nil {
+		return err
+	}
+
+	headers := []*tar.Header{
+		{
+			Typeflag: tar.TypeDir,
+			Name:     PROVENANCE_DIRECTORY + "/",
+			Mode:     0755,
+			ModTime:  archiveModTime,
+			Format:   tar.FormatPAX,
+		},
+		{
+			Typeflag: tar.TypeReg,
+			Name:     PROVENANCE_FILE,
+			Size:     int64(len(manifest)),
+			Mode:     0644,
+			ModTime:  archiveModTime,
+			Format:   tar.FormatPAX,
+		},
+	}
+	for _, header := range headers {
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+	}
+	_, err = tw.Write(manifest)
+	return err
+}
+
+func isVolatileGitPath(name string) bool {
+	for _, p := range volatileGitPaths {
+		if name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// git only tracks the executable bit so permissions are collapsed to match
+func normalizedMode(mode os.FileMode) int64 {
+	if mode&0111 != 0 {
+		return 0755
+	}
+	return 0644
+}
+
+// unpacks tar compressed with codec produced by writeTar from r into dest
+// entries resolving outside of dest are rejected. compression checksum is validated once the tar ends
+func extractTar(ctx context.Context, r io.Reader, dest string, codec compression) error {
+	cr, err := codec.newReader(r)
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+	tr := tar.NewReader(cr)
+
+	root := filepath.Clean(dest) + string(filepath.Separator)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-		gs.tarPath = tarPath
+		target := filepath.Join(dest, filepath.FromSlash(header.Name))
+		if !strings.HasPrefix(target+string(filepath.Separator), root) {
+			return fmt.Errorf("Archive entry %q resolves outside of %s", header.Name, dest)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			f.Close()
+		}
 	}
 
-	return nil
+	// reading to the end of the compressed stream verifies its checksum
+	_, err = io.Copy(io.Discard, cr)
+	return err
 }
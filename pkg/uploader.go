@@ -2,15 +2,21 @@ package pkg
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os/exec"
+	"strings"
 	"time"
 
+	"github.com/app-sre/git-partition-sync-producer/pkg/signature"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/machinebox/graphql"
 	"github.com/xanzy/go-gitlab"
@@ -18,18 +24,46 @@ import (
 )
 
 type Uploader struct {
-	awsRegion  string
-	bucket     string
-	glBaseURL  string
-	glUsername string
-	glToken    string
-	publicKey  string
-	workdir    string
-
-	glClient *gitlab.Client
-	s3Client *s3.Client
-
+	awsRegion      string
+	bucket         string
+	glBaseURL      string
+	glUsername     string
+	glToken        string
+	workdir        string
+	concurrency    int
+	gracePeriod    time.Duration
+	verifyArchives bool
+	compression    compression
+	instance       string
+	// global size limit in bytes of source repositories and artifacts. 0 is unlimited
+	maxSize int64
+	// artifacts larger than this are uploaded as chunks. 0 disables chunking
+	maxObjectSize int64
+	// number of artifacts re-encrypted to changed recipients per run. 0 disables re-encryption
+	reencryptLimit int
+	// nil when artifacts are not signed
+	signingKey ed25519.PrivateKey
+	// nil when secret scanning is disabled
+	secretScanner *secretScanner
+
+	glClient   *gitlab.Client
+	s3Client   *s3.Client
+	s3Uploader *manager.Uploader
+
+	// sources of config reloaded by Refresh
+	configSource    ConfigSource
+	publicKey       string
+	publicKeyFile   string
+	recipientPolicy *RecipientPolicy
+
+	// loaded config. see apply
 	syncs []*SyncConfig
+	// identifies config syncs were loaded from. see ConfigSource
+	bundleSha string
+	// recipients of artifacts of syncs without a recipient override. see loadRecipients
+	recipients *recipientSet
+	// syncs rejected by ValidateConfig. they are failed within each run
+	rejected map[*SyncConfig]error
 }
 
 type Apps struct {
@@ -47,134 +81,317 @@ type GitlabSync struct {
 type SyncConfig struct {
 	Source      GitTarget `yaml:"sourceProject"`
 	Destination GitTarget `yaml:"destinationProject"`
-	repoPath    string
-	tarPath     string
-	encryptPath string
+	// one of MODE_HISTORY (default when unset) or MODE_SNAPSHOT
+	Mode string `yaml:"mode"`
+	// glob patterns of paths to package (all when empty) and to omit. see pathFilter
+	// only supported with MODE_SNAPSHOT as git history would still contain omitted paths
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+	// size limit of source repository and artifact (ex: 500Mi). see parseSize
+	// lowers the global limit when set
+	MaxSize string `yaml:"maxSize"`
+	// recipient alias or keys overriding the global public key. see RecipientPolicy
+	Recipient string `yaml:"recipient"`
+
+	// resolved Recipient. nil when the global recipients apply
+	recipients *recipientSet
 }
 
+const (
+	// full clone including git history is packaged
+	MODE_HISTORY = "history"
+	// only the tree at the synced commit is packaged. consumer creates a snapshot commit from it
+	MODE_SNAPSHOT = "snapshot"
+)
+
 type GitTarget struct {
 	ProjectName string `yaml:"name"`
 	Group       string `yaml:"group"`
 	Branch      string `yaml:"branch"`
 }
 
-func NewUploader(
-	ctx context.Context,
-	awsAccessKey,
-	awsSecretKey,
-	awsRegion,
-	bucket,
-	glURL,
-	glUsername,
-	glToken,
-	gqlURL,
-	gqlFile,
-	gqlUsername,
-	gqlPassword,
-	pubKey,
-	workdir string) (*Uploader, error) {
-
-	cfg, err := getConfig(ctx, gqlURL, gqlFile, gqlUsername, gqlPassword)
+// returns gitlab PID (gitlab_group/project_name) of sync source
+func (s *SyncConfig) sourcePid() string {
+	return fmt.Sprintf("%s/%s", s.Source.Group, s.Source.ProjectName)
+}
+
+// returns source ref (gitlab_group/project_name:branch) of sync
+// colon is not valid within git ref names so the separator cannot be ambiguous
+func (s *SyncConfig) sourceRef() string {
+	return fmt.Sprintf("%s:%s", s.sourcePid(), s.Source.Branch)
+}
+
+// returns export mode of sync. unset mode defaults to MODE_HISTORY
+func (s *SyncConfig) exportMode() (string, error) {
+	switch s.Mode {
+	case "", MODE_HISTORY:
+		return MODE_HISTORY, nil
+	case MODE_SNAPSHOT:
+		return MODE_SNAPSHOT, nil
+	}
+	return "", fmt.Errorf("Unsupported mode %q for sync to %s. must be one of %s or %s",
+		s.Mode, s.destinationPid(), MODE_HISTORY, MODE_SNAPSHOT)
+}
+
+// returns filter of paths packaged for sync. nil if all paths are packaged
+func (s *SyncConfig) pathFilter() (*pathFilter, error) {
+	if len(s.Include) == 0 && len(s.Exclude) == 0 {
+		return nil, nil
+	}
+	if mode, _ := s.exportMode(); mode != MODE_SNAPSHOT {
+		return nil, fmt.Errorf("Include and exclude of sync to %s require mode %s. git history would still contain omitted paths",
+			s.destinationPid(), MODE_SNAPSHOT)
+	}
+	return newPathFilter(s.Include, s.Exclude)
+}
+
+// returns gitlab PID (gitlab_group/project_name) of sync destination
+func (s *SyncConfig) destinationPid() string {
+	return fmt.Sprintf("%s/%s", s.Destination.Group, s.Destination.ProjectName)
+}
+
+// UploaderConfig holds values required to construct an Uploader
+type UploaderConfig struct {
+	AWSAccessKey   string
+	AWSSecretKey   string
+	AWSRegion      string
+	Bucket         string
+	GitlabURL      string
+	GitlabUsername string
+	GitlabToken    string
+	// provides syncs. see NewGraphqlConfigSource and NewFileConfigSource
+	ConfigSource ConfigSource
+	PublicKey    string
+	// path to file of public keys, one per line. combined with PublicKey
+	PublicKeyFile string
+	Workdir       string
+	// number of source repositories processed in parallel
+	Concurrency int
+	// time in flight uploads are allowed to complete once the run context is cancelled
+	GracePeriod time.Duration
+	// unpack and git fsck each archive before it is published
+	VerifyArchives bool
+	// archive compression of format codec[:level]. see parseCompression
+	Compression string
+	// identifies this producer within provenance manifests
+	Instance string
+	// block syncs whose new commits contain credentials
+	SecretScan bool
+	// optional yaml or json file extending builtin secret scan rules. see scanConfig
+	SecretScanRules string
+	// size limit of every source repository and artifact (ex: 2Gi). see parseSize. empty is unlimited
+	MaxSize string
+	// size of s3 objects above which artifacts are split into chunks (ex: 1Gi). empty disables chunking
+	MaxObjectSize string
+	// number of up to date artifacts re-encrypted per run once recipients change. 0 disables re-encryption
+	ReencryptLimit int
+	// PEM encoded ed25519 private key artifacts are signed with. empty disables signing
+	SigningKey string
+	// yaml or json map of alias to public keys that syncs may reference as recipient
+	RecipientAliases string
+	// fingerprints every recipient must match, separated by commas or whitespace. empty disables pinning
+	PublicKeyFingerprints string
+}
+
+func NewUploader(ctx context.Context, c UploaderConfig) (*Uploader, error) {
+	if c.Concurrency < 1 {
+		return nil, fmt.Errorf("Concurrency must be at least 1, got %d", c.Concurrency)
+	}
+	if c.ReencryptLimit < 0 {
+		return nil, fmt.Errorf("Re-encrypt limit must not be negative, got %d", c.ReencryptLimit)
+	}
+
+	codec, err := parseCompression(c.Compression)
 	if err != nil {
 		return nil, err
 	}
+	if codec.String() != c.Compression && c.Compression != "" {
+		log.Printf("Compression %s is applied as %s", c.Compression, codec)
+	}
 
-	cmd := exec.Command("mkdir", "-p", workdir)
+	maxSize, err := parseSize(c.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	maxObjectSize, err := parseSize(c.MaxObjectSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateObjectSize(maxObjectSize); err != nil {
+		return nil, err
+	}
+
+	var signingKey ed25519.PrivateKey
+	if c.SigningKey != "" {
+		signingKey, err = signature.ParsePrivateKey([]byte(c.SigningKey))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var scanner *secretScanner
+	if c.SecretScan {
+		scanner, err = newSecretScanner(c.SecretScanRules)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	recipientPolicy, err := NewRecipientPolicy(c.RecipientAliases, c.PublicKeyFingerprints)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("mkdir", "-p", c.Workdir)
 	err = cmd.Run()
 	if err != nil {
 		return nil, err
 	}
 
+	// retries are performed by the shared retry policy so attempts are not multiplied
 	gl, err := gitlab.NewClient(
-		glToken, gitlab.WithBaseURL(fmt.Sprintf("%s/api/v4", glURL)))
+		c.GitlabToken,
+		gitlab.WithBaseURL(fmt.Sprintf("%s/api/v4", c.GitlabURL)),
+		gitlab.WithoutRetries(),
+	)
 	if err != nil {
 		return nil, err
 	}
 
-	awsS3 := s3.New(s3.Options{
-		Region: awsRegion,
+	s3Options := s3.Options{
+		Region: c.AWSRegion,
 		Credentials: aws.NewCredentialsCache(credentials.NewStaticCredentialsProvider(
-			awsAccessKey,
-			awsSecretKey,
+			c.AWSAccessKey,
+			c.AWSSecretKey,
 			"",
 		)),
+	}
+	// retries of operations are performed by the shared retry policy so attempts are not multiplied
+	awsS3 := s3.New(s3Options, func(o *s3.Options) {
+		o.Retryer = aws.NopRetryer{}
+	})
+
+	// the multipart manager keeps sdk retries so a transient error on a single part is retried
+	// alone rather than restarting the whole streamed upload through the shared retry policy
+	s3Parts := s3.New(s3Options)
+
+	// uploads are streamed; part size and concurrency bound the memory consumed per upload
+	s3Uploader := manager.NewUploader(s3Parts, func(mu *manager.Uploader) {
+		mu.PartSize = manager.MinUploadPartSize
+		mu.Concurrency = 2
 	})
 
-	return &Uploader{
-		awsRegion:  awsRegion,
-		bucket:     bucket,
-		glBaseURL:  glURL,
-		glUsername: glUsername,
-		glToken:    glToken,
-		publicKey:  pubKey,
-		workdir:    workdir,
-		glClient:   gl,
-		s3Client:   awsS3,
-		syncs:      cfg,
-	}, nil
+	u := &Uploader{
+		awsRegion:      c.AWSRegion,
+		bucket:         c.Bucket,
+		glBaseURL:      c.GitlabURL,
+		glUsername:     c.GitlabUsername,
+		glToken:        c.GitlabToken,
+		workdir:        c.Workdir,
+		concurrency:    c.Concurrency,
+		gracePeriod:    c.GracePeriod,
+		verifyArchives: c.VerifyArchives,
+		compression:    codec,
+		instance:       c.Instance,
+		maxSize:        maxSize,
+		maxObjectSize:  maxObjectSize,
+		reencryptLimit: c.ReencryptLimit,
+		signingKey:     signingKey,
+		secretScanner:  scanner,
+		glClient:       gl,
+		s3Client:       awsS3,
+		s3Uploader:     s3Uploader,
+
+		configSource:    c.ConfigSource,
+		publicKey:       c.PublicKey,
+		publicKeyFile:   c.PublicKeyFile,
+		recipientPolicy: recipientPolicy,
+	}
+
+	// there is no previous config to fall back to, so failure to load is fatal
+	cfg, err := u.loadConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u.apply(cfg)
+	return u, nil
 }
 
 // Run executes steps to reconcile s3 bucket with existing state of gitlab projects
-func (u *Uploader) Run(ctx context.Context, dryRun bool) error {
+// cancelling ctx stops new work from starting and lets in flight uploads finish within the grace period
+// failure of an individual sync is recorded within the returned RunResult and does not
+// prevent other syncs from being published. error is only returned for failures affecting all syncs
+func (u *Uploader) Run(ctx context.Context, dryRun bool) (*RunResult, error) {
 	log.Println("Starting run...")
 
 	defer u.clear()
 
-	glCommits, err := u.getLatestGitlabCommits()
-	if err != nil {
-		return err
+	result := newRunResult(u.syncs)
+	for _, gs := range u.syncs {
+		if err, rejected := u.rejected[gs]; rejected {
+			result.fail(gs, err)
+		}
 	}
 
-	s3ObjectInfos, err := u.getS3Keys(ctx)
-	if err != nil {
-		return err
-	}
+	glCommits := u.getLatestGitlabCommits(ctx, result)
 
-	toUpdate, toDelete, err := u.getOutOfSync(ctx, glCommits, s3ObjectInfos)
+	s3ObjectInfos, unreferenced, err := u.getS3Keys(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = u.cloneRepos(toUpdate)
-	if err != nil {
-		return err
+	if u.reencryptLimit > 0 {
+		u.getRecipients(ctx, glCommits, s3ObjectInfos)
 	}
 
-	err = u.tarRepos(toUpdate)
+	toUpdate, orphaned := u.getOutOfSync(glCommits, s3ObjectInfos, u.recipients, result)
+	orphaned = append(orphaned, unreferenced...)
+
+	err = u.clean(CLONE_DIRECTORY)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = u.encryptRepoTars(toUpdate)
-	if err != nil {
-		return err
+	jobs := groupBySource(toUpdate, glCommits)
+	u.processJobs(ctx, jobs, u.recipients, dryRun, result)
+
+	// superseded artifacts are only removed for syncs that were successfully updated
+	toDelete := append(orphaned, result.staleKeys()...)
+
+	// deletions are skipped when interrupted so the bucket is never left with fewer artifacts
+	// than before the run began. they are picked up by the next run
+	if err := ctx.Err(); err != nil {
+		return result, fmt.Errorf("Run interrupted, skipped deletion of %d s3 objects: %w", len(toDelete), err)
 	}
 
 	if dryRun {
-		printDryRun(toUpdate, toDelete)
-		return nil
+		printDryRun(result, toDelete)
+		return result, nil
 	}
 
-	err = u.uploadLatest(ctx, toUpdate, glCommits)
-	if err != nil {
-		return err
-	}
-	for _, update := range toUpdate {
-		fmt.Println(fmt.Sprintf("s3 object for destination PID `%s/%s` successfully updated",
-			update.Destination.Group,
-			update.Destination.ProjectName))
+	for _, sr := range result.Syncs {
+		if sr.Status == SyncUpdated {
+			fmt.Println(fmt.Sprintf("s3 object for destination PID `%s` successfully updated. archive sha256: %s",
+				sr.DestinationPid, sr.ArchiveSHA256))
+		}
 	}
 
 	err = u.removeOutdated(ctx, toDelete)
 	if err != nil {
-		return err
+		return result, err
 	}
 	for _, delete := range toDelete {
+		result.Deleted = append(result.Deleted, *delete)
 		fmt.Println(fmt.Sprintf("s3 object with key `%s` successfully deleted", *delete))
 	}
 
-	log.Println("Run successfully completed")
-	return nil
+	if result.Status() == RunDegraded {
+		log.Printf("Run completed with failures: %s", result)
+	} else {
+		log.Println("Run successfully completed")
+	}
+	return result, nil
 }
 
 type DecodedKey struct {
@@ -183,6 +400,17 @@ type DecodedKey struct {
 	CommitSHA    string `json:"commit_sha"`
 	LocalBranch  string `json:"local_branch"`
 	RemoteBranch string `json:"remote_branch"`
+	// codec of archive (none, gzip or zstd). absent within keys of objects
+	// uploaded prior to codec selection which are always gzip
+	Compression string `json:"compression,omitempty"`
+	// history or snapshot. absent within keys of objects uploaded prior to
+	// mode selection which are always history
+	Mode string `json:"mode,omitempty"`
+	// digest of include and exclude lists (see filterDigest). absent when all paths are packaged
+	Filters string `json:"filters,omitempty"`
+	// digest of the recipient set (see recipientSet.digest). absent within keys of objects uploaded
+	// prior to its introduction, whose recipients are only recorded within metadata
+	Recipients string `json:"recipients,omitempty"`
 }
 
 // query graphql and convert result into objects for reconcile
@@ -227,75 +455,147 @@ func GetGraphqlRaw(ctx context.Context, gqlUrl, gqlFile, gqlUsername, gqlPassowr
 
 	req := graphql.NewRequest(string(query))
 
-	// default values
-	if gqlUsername != "dev" && gqlPassowrd != "dev" {
-		req.Header.Set("Authorization",
-			fmt.Sprintf("Basic %s",
-				base64.StdEncoding.EncodeToString(
-					[]byte(fmt.Sprintf("%s:%s", gqlUsername, gqlPassowrd)),
-				),
-			),
-		)
-	}
+	setGraphqlAuth(req.Header, gqlUsername, gqlPassowrd)
 
 	// execute query with retry logic and capture the response
 	var rawCfg map[string]interface{}
-	for _, backoff := range []time.Duration{1 * time.Second, 3 * time.Second, 10 * time.Second} {
+	err = retry(ctx, "graphql_query", graphqlRetryPolicy, func(ctx context.Context) error {
 		ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*10)
 		defer cancel()
 
-		err = client.Run(ctxTimeout, req, &rawCfg)
-		if err == nil {
-			break
-		}
-
-		log.Println(err)
-		time.Sleep(backoff)
-	}
-
+		return client.Run(ctxTimeout, req, &rawCfg)
+	})
 	if err != nil {
 		return nil, err
 	}
 	return rawCfg, nil
 }
 
+// returns sha256 of the bundle currently served by the graphql server
+// qontract-server exposes it at `/sha256` alongside the `/graphql` endpoint
+func getBundleSha(ctx context.Context, gqlUrl, gqlUsername, gqlPassword string) (string, error) {
+	slicedUrl := strings.Split(gqlUrl, "/")
+	shaUrl := fmt.Sprintf("%s/sha256", strings.Join(slicedUrl[:len(slicedUrl)-1], "/"))
+
+	var sha string
+	err := retry(ctx, "graphql_bundle_sha", graphqlRetryPolicy, func(ctx context.Context) error {
+		ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*10)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctxTimeout, http.MethodGet, shaUrl, nil)
+		if err != nil {
+			return permanent(err)
+		}
+		setGraphqlAuth(req.Header, gqlUsername, gqlPassword)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			err = fmt.Errorf("Unexpected status %d from %s", res.StatusCode, shaUrl)
+			if res.StatusCode < http.StatusInternalServerError {
+				return permanent(err)
+			}
+			return err
+		}
+		sha = strings.TrimSpace(string(body))
+		return nil
+	})
+	return sha, err
+}
+
+// sets basic auth header unless default credentials are in use
+func setGraphqlAuth(header http.Header, gqlUsername, gqlPassword string) {
+	// default values
+	if gqlUsername != "dev" && gqlPassword != "dev" {
+		header.Set("Authorization",
+			fmt.Sprintf("Basic %s",
+				base64.StdEncoding.EncodeToString(
+					[]byte(fmt.Sprintf("%s:%s", gqlUsername, gqlPassword)),
+				),
+			),
+		)
+	}
+}
+
 // iterates through desired Syncs (defined within config file)
 // and compares latest commits on source GitLab projects against
 // commits stored within s3 keys for corresponding destination GitLab projects
 // return is slice of Sync that do not exist within s3Commits OR s3Commit != glCommit
-// and slice of s3 object keys to delete
-func (u *Uploader) getOutOfSync(ctx context.Context, glCommits pidToCommit,
-	objInfos map[string]*s3ObjectInfo) ([]*SyncConfig, []*string, error) {
+// and slice of s3 object keys no longer belonging to any sync
+// keys superseded by an out of date sync are recorded within result to be deleted once updated
+// up to date artifacts encrypted to a different recipient set are also returned, at most
+// u.reencryptLimit per run so that rotating keys does not re-upload the entire bucket at once
+func (u *Uploader) getOutOfSync(glCommits refToCommit, objInfos map[string]*s3ObjectInfo,
+	recipients *recipientSet, result *RunResult) ([]*SyncConfig, []*string) {
 
 	outdated := []*SyncConfig{}
-	toDelete := []*string{}
+	orphaned := []*string{}
+	reencrypt := 0
+	pending := 0
 	for _, sync := range u.syncs {
-		sourcePid := fmt.Sprintf("%s/%s", sync.Source.Group, sync.Source.ProjectName)
-		destinationPid := fmt.Sprintf("%s/%s", sync.Destination.Group, sync.Destination.ProjectName)
+		destinationPid := sync.destinationPid()
 
 		objInfo, exist := objInfos[destinationPid]
-		if !exist {
+		if result.failed(sync) {
+			// latest commit is unknown. existing object is retained as is
+			delete(objInfos, destinationPid)
+		} else if !exist {
 			// new target added to config file
 			outdated = append(outdated, sync)
-		} else if objInfo.CommitSHA != glCommits[sourcePid] {
-			// existing target is out of date
+		} else if objInfo.CommitSHA != glCommits[sync.sourceRef()] || !u.packagedAsConfigured(sync, objInfo) {
+			// existing target is out of date or was packaged with a different codec, mode or filters
 			outdated = append(outdated, sync)
-			toDelete = append(toDelete, objInfo.Key)
+			result.supersede(sync, objInfo)
 
 			delete(objInfos, destinationPid) // remove processed keys from s3 bucket map
+		} else if objInfo.encryptedToOtherRecipients(sync.encryptionRecipients(recipients)) {
+			if reencrypt < u.reencryptLimit {
+				// existing target is up to date but must be re-encrypted. the recipients digest within the
+				// key differs, so it is published under a new key and the existing one deleted once complete
+				log.Printf("s3 object for destination PID `%s` is encrypted to other recipients, re-encrypting to [%s]",
+					destinationPid, sync.encryptionRecipients(recipients))
+				outdated = append(outdated, sync)
+				result.supersede(sync, objInfo)
+				reencrypt++
+			} else {
+				pending++
+			}
+			delete(objInfos, destinationPid)
 		} else {
 			// target is up to date
 			delete(objInfos, destinationPid)
 		}
 	}
+	reencryptPendingGauge.Set(float64(pending))
+	if pending > 0 {
+		log.Printf("%d s3 objects pending re-encryption beyond limit of %d per run", pending, u.reencryptLimit)
+	}
 
 	// if map is not empty at end, there are s3 keys that should be deleted
 	// i.e removed from config file as targets
 	for _, obj := range objInfos {
-		toDelete = append(toDelete, obj.Key)
+		orphaned = append(orphaned, obj.keys()...)
 	}
 
-	return outdated, toDelete, nil
+	return outdated, orphaned
+}
+
+// returns true if existing object was packaged with the configured codec, mode and filters of sync
+// and is signed when signing is enabled
+func (u *Uploader) packagedAsConfigured(sync *SyncConfig, objInfo *s3ObjectInfo) bool {
+	// an invalid mode never matches. the sync fails once it is packaged
+	mode, _ := sync.exportMode()
+	return objInfo.Compression == u.compression.codec && objInfo.Mode == mode &&
+		objInfo.Filters == filterDigest(sync.Include, sync.Exclude) &&
+		(u.signingKey == nil || objInfo.Signature != nil)
 }
 
 // clean target working directory
@@ -317,7 +617,7 @@ func (u *Uploader) clean(directory string) error {
 
 // clear all items in working directory
 func (u *Uploader) clear() error {
-	cmd := exec.Command("rm", "-rf", ENCRYPT_DIRECTORY, TAR_DIRECTORY, CLONE_DIRECTORY)
+	cmd := exec.Command("rm", "-rf", CLONE_DIRECTORY, VERIFY_DIRECTORY)
 	cmd.Dir = u.workdir
 	err := cmd.Run()
 	if err != nil {
@@ -326,14 +626,19 @@ func (u *Uploader) clear() error {
 	return nil
 }
 
-func printDryRun(toUpdate []*SyncConfig, toDelete []*string) {
-	for _, update := range toUpdate {
-		fmt.Println(fmt.Sprintf("[DRY RUN] s3 object for destination PID `%s/%s` will be updated",
-			update.Destination.Group,
-			update.Destination.ProjectName))
+func printDryRun(result *RunResult, toDelete []*string) {
+	for _, sr := range result.Syncs {
+		if sr.Status == SyncPlanned {
+			fmt.Println(fmt.Sprintf("[DRY RUN] s3 object for destination PID `%s` will be updated. archive sha256: %s",
+				sr.DestinationPid, sr.ArchiveSHA256))
+		}
 	}
 	for _, delete := range toDelete {
 		fmt.Println(fmt.Sprintf("[DRY RUN] s3 object with key `%s` will be deleted", *delete))
 	}
-	log.Println("[DRY RUN] Run successfully completed")
+	if result.Status() == RunDegraded {
+		log.Printf("[DRY RUN] Run completed with failures: %s", result)
+	} else {
+		log.Println("[DRY RUN] Run successfully completed")
+	}
 }
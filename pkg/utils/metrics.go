@@ -1,8 +1,10 @@
 package utils
 
 import (
+	"fmt"
 	"time"
 
+	"github.com/app-sre/git-partition-sync-producer/pkg"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -10,7 +12,7 @@ var (
 	reconcileSuccessCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "qontract_reconcile_execution_counter_total",
-			Help: "Increment by one for each successful reconcile. Used to alert on 'stuck' instance reconciles",
+			Help: "Increment by one for each completed (successful or degraded) reconcile. Used to alert on 'stuck' instance reconciles",
 		},
 		[]string{
 			"shard_id",
@@ -21,13 +23,35 @@ var (
 		prometheus.GaugeOpts{
 			Name: "qontract_reconcile_last_run_status",
 			Help: `Whether or not last reconcile run was successful. ` +
-				`A reconcile is successful if no errors occur. 0 = success. 1 = failure.`,
+				`A reconcile is successful if no errors occur. 0 = success. 1 = failure. ` +
+				`2 = degraded (at least one sync failed).`,
 		},
 		[]string{
 			"shard_id",
 			"integration",
 		},
 	)
+	syncFailedGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "git_partition_sync_producer_sync_failed",
+			Help: "Whether or not the last attempt of a sync failed. 0 = success. 1 = failure.",
+		},
+		[]string{
+			"shard_id",
+			"source",
+			"destination",
+		},
+	)
+	syncOutcomeCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "git_partition_sync_producer_sync_outcome_total",
+			Help: "Increment by one for each sync outcome. Outcome is one of up_to_date, updated, planned or failed",
+		},
+		[]string{
+			"shard_id",
+			"outcome",
+		},
+	)
 	executionDurationGauge = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "qontract_reconcile_last_run_seconds",
@@ -45,6 +69,8 @@ func init() {
 	prometheus.MustRegister(reconcileSuccessCounter)
 	prometheus.MustRegister(lastReconcileSuccessGauge)
 	prometheus.MustRegister(executionDurationGauge)
+	prometheus.MustRegister(syncFailedGauge)
+	prometheus.MustRegister(syncOutcomeCounter)
 }
 
 func RecordMetrics(instance string, status int, duration time.Duration) {
@@ -56,8 +82,9 @@ func RecordMetrics(instance string, status int, duration time.Duration) {
 			"integration": INTEGRATION,
 		}).Set(float64(status))
 
-	// only inc counter metric for successful reconciles
-	if status == 0 {
+	// a degraded run still completed. only hard failures must stop the counter so a single
+	// failing sync does not fire the stuck reconcile alert
+	if status != int(pkg.RunFailure) {
 		reconcileSuccessCounter.With(
 			prometheus.Labels{
 				"shard_id":    instance,
@@ -71,3 +98,28 @@ func RecordMetrics(instance string, status int, duration time.Duration) {
 			"integration": INTEGRATION,
 		}).Set(duration.Seconds())
 }
+
+// records outcome of each sync within a run
+func RecordSyncResults(instance string, result *pkg.RunResult) {
+	// reset so that syncs removed from config do not report stale values
+	syncFailedGauge.Reset()
+
+	for _, sr := range result.Syncs {
+		failed := 0
+		if sr.Status == pkg.SyncFailed {
+			failed = 1
+		}
+		syncFailedGauge.With(
+			prometheus.Labels{
+				"shard_id":    instance,
+				"source":      fmt.Sprintf("%s:%s", sr.SourcePid, sr.SourceBranch),
+				"destination": fmt.Sprintf("%s:%s", sr.DestinationPid, sr.DestinationBranch),
+			}).Set(float64(failed))
+
+		syncOutcomeCounter.With(
+			prometheus.Labels{
+				"shard_id": instance,
+				"outcome":  string(sr.Status),
+			}).Inc()
+	}
+}
@@ -0,0 +1,176 @@
+package pkg
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	// sync is not reconciled. its existing artifact is retained
+	SEVERITY_ERROR = "error"
+	// sync is reconciled. the issue is only reported
+	SEVERITY_WARNING = "warning"
+)
+
+// ConfigIssue is a problem of a single sync found by ValidateConfig
+type ConfigIssue struct {
+	Severity string
+	// position of the sync within loaded config, starting at 1
+	Position int
+	// source and destination of the sync
+	Sync    string
+	Message string
+}
+
+func (i ConfigIssue) String() string {
+	return fmt.Sprintf("%s: sync #%d %s: %s", i.Severity, i.Position, i.Sync, i.Message)
+}
+
+// ValidationReport is the outcome of ValidateConfig
+type ValidationReport struct {
+	// ordered by position
+	Issues []ConfigIssue
+
+	// loaded syncs without exact duplicates, including rejected syncs
+	syncs []*SyncConfig
+	// syncs with at least one error mapped to their combined errors
+	rejected map[*SyncConfig]error
+}
+
+// ValidateConfig checks loaded syncs for problems graphql and config files do not prevent
+// syncs with errors are rejected individually so a single bad entry does not block other syncs.
+// recipient overrides are resolved against policy and recorded on each sync
+func ValidateConfig(syncs []*SyncConfig, policy *RecipientPolicy) *ValidationReport {
+	report := &ValidationReport{
+		Issues:   []ConfigIssue{},
+		syncs:    []*SyncConfig{},
+		rejected: make(map[*SyncConfig]error),
+	}
+	positions := make(map[*SyncConfig]int)
+	errs := make(map[*SyncConfig][]string)
+	add := func(severity string, gs *SyncConfig, format string, args ...interface{}) {
+		message := fmt.Sprintf(format, args...)
+		report.Issues = append(report.Issues, ConfigIssue{
+			Severity: severity,
+			Position: positions[gs],
+			Sync:     gs.describe(),
+			Message:  message,
+		})
+		if severity == SEVERITY_ERROR {
+			errs[gs] = append(errs[gs], message)
+		}
+	}
+
+	byDestination := make(map[string][]*SyncConfig)
+	for i, gs := range syncs {
+		positions[gs] = i + 1
+		if original := findDuplicate(report.syncs, gs); original != nil {
+			add(SEVERITY_WARNING, gs, "duplicate of sync #%d, ignored", positions[original])
+			continue
+		}
+		report.syncs = append(report.syncs, gs)
+		byDestination[gs.destinationPid()] = append(byDestination[gs.destinationPid()], gs)
+
+		for _, problem := range gs.problems() {
+			add(SEVERITY_ERROR, gs, "%s", problem)
+		}
+		// legitimate when source and destination are distinct gitlab instances, which cannot be told apart here
+		if gs.Source == gs.Destination {
+			add(SEVERITY_WARNING, gs, "source and destination are the same project and branch")
+		}
+	}
+
+	for _, gs := range report.syncs {
+		// resolved once duplicates are dropped as resolution alters syncs compared by findDuplicate
+		recipients, err := policy.resolve(gs)
+		if err != nil {
+			add(SEVERITY_ERROR, gs, "%v", err)
+		}
+		gs.recipients = recipients
+
+		// artifacts are keyed by destination project, so syncs sharing one would overwrite each other
+		for _, other := range byDestination[gs.destinationPid()] {
+			if other != gs {
+				add(SEVERITY_ERROR, gs, "destination %s is also targeted by sync #%d %s",
+					gs.destinationPid(), positions[other], other.describe())
+			}
+		}
+	}
+
+	sort.SliceStable(report.Issues, func(i, j int) bool {
+		return report.Issues[i].Position < report.Issues[j].Position
+	})
+	for gs, messages := range errs {
+		report.rejected[gs] = fmt.Errorf("Rejected by config validation: %s", strings.Join(messages, "; "))
+	}
+	return report
+}
+
+// returns the sync within syncs that gs is an exact copy of. nil if there is none
+func findDuplicate(syncs []*SyncConfig, gs *SyncConfig) *SyncConfig {
+	for _, other := range syncs {
+		if reflect.DeepEqual(*other, *gs) {
+			return other
+		}
+	}
+	return nil
+}
+
+// returns problems of gs that prevent it from being reconciled
+func (s *SyncConfig) problems() []string {
+	problems := []string{}
+	for _, target := range []struct {
+		name   string
+		target GitTarget
+	}{
+		{"source", s.Source},
+		{"destination", s.Destination},
+	} {
+		if target.target.Group == "" {
+			problems = append(problems, fmt.Sprintf("%s group is empty", target.name))
+		}
+		if target.target.ProjectName == "" {
+			problems = append(problems, fmt.Sprintf("%s project name is empty", target.name))
+		}
+		if target.target.Branch == "" {
+			problems = append(problems, fmt.Sprintf("%s branch is empty", target.name))
+		}
+	}
+	if _, err := s.exportMode(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := s.pathFilter(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := parseSize(s.MaxSize); err != nil {
+		problems = append(problems, fmt.Sprintf("maxSize: %v", err))
+	}
+	return problems
+}
+
+// returns `source:branch` -> `destination:branch` for reports
+func (s *SyncConfig) describe() string {
+	return fmt.Sprintf("`%s` -> `%s:%s`", s.sourceRef(), s.destinationPid(), s.Destination.Branch)
+}
+
+// HasErrors returns true if any sync was rejected
+func (r *ValidationReport) HasErrors() bool {
+	return len(r.rejected) > 0
+}
+
+// String returns a human readable report listing every issue followed by a summary
+func (r *ValidationReport) String() string {
+	var b strings.Builder
+	warnings := 0
+	for _, issue := range r.Issues {
+		if issue.Severity == SEVERITY_WARNING {
+			warnings++
+		}
+		b.WriteString(issue.String())
+		b.WriteString("\n")
+	}
+	b.WriteString(fmt.Sprintf("%d syncs, %d rejected, %d warnings", len(r.syncs), len(r.rejected), warnings))
+	return b.String()
+}
@@ -0,0 +1,75 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const VERIFY_DIRECTORY = "verify"
+
+// verifies archives of history syncs before they are published. history syncs failing verification
+// are failed within result. return is syncs that passed, including snapshot syncs which are not verified
+// as they carry no git objects to check
+//
+// history archives of a job only differ by the destination recorded within their manifest,
+// so the archive of the first history sync is verified on behalf of all of them
+func (u *Uploader) verifyHistory(ctx context.Context, job *sourceJob, syncs []*SyncConfig, result *RunResult) []*SyncConfig {
+	passed := []*SyncConfig{}
+	history := []*SyncConfig{}
+	for _, gs := range syncs {
+		if mode, _ := gs.exportMode(); mode == MODE_SNAPSHOT {
+			passed = append(passed, gs)
+		} else {
+			history = append(history, gs)
+		}
+	}
+	if len(history) == 0 {
+		return passed
+	}
+
+	if err := u.verifyArchive(ctx, job, history[0]); err != nil {
+		for _, gs := range history {
+			result.fail(gs, err)
+		}
+		return passed
+	}
+	return append(passed, history...)
+}
+
+// unpacks the archive gs publishes from job into a scratch directory and runs git fsck against the result
+// catches entries lost or altered by packaging (symlinks, modes, git objects) before publishing
+func (u *Uploader) verifyArchive(ctx context.Context, job *sourceJob, gs *SyncConfig) error {
+	opts, err := u.archiveOptions(job, gs)
+	if err != nil {
+		return err
+	}
+
+	dest := filepath.Join(u.workdir, VERIFY_DIRECTORY, job.workspacePath())
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dest)
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeTar(ctx, pw, job.repoPath, opts))
+	}()
+	err = extractTar(ctx, pr, dest, u.compression)
+	// unblock writer in the event extraction stopped early
+	pr.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+
+	err = u.git(ctx, dest, "fsck", "--full", "--no-dangling")
+	if err != nil {
+		return fmt.Errorf("Unpacked archive of %s failed verification: %v", job.pid, err)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/app-sre/git-partition-sync-producer/pkg"
+)
+
+// loads syncs from graphql or a config file and reports problems without syncing
+// usage: validate [-config-file <path>]. exits 1 if any sync is rejected
+func runValidate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFile := fs.String("config-file", os.Getenv("CONFIG_FILE"),
+		"Path to yaml or json file of syncs. If not set, syncs are queried from graphql")
+	fs.Parse(args)
+
+	configSource, err := newConfigSource(*configFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	syncs, _, err := configSource.Load(context.Background())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// recipient overrides are resolved as they would be by the producer
+	policy, err := pkg.NewRecipientPolicy(os.Getenv("RECIPIENT_ALIASES"), os.Getenv("PUBLIC_KEY_FINGERPRINTS"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	report := pkg.ValidateConfig(syncs, policy)
+	fmt.Println(report)
+	if report.HasErrors() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/app-sre/git-partition-sync-producer/pkg/signature"
+)
+
+// verifies a downloaded artifact against its detached signature
+// usage: verify -public-key <pem> -key <object key> -signature <file> <artifact or chunk files in order>...
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	publicKeyFile := fs.String("public-key", "", "Path to PEM encoded ed25519 public key of the producer")
+	objectKey := fs.String("key", "", "s3 key the artifact was published as. for chunked artifacts, the key without .index")
+	signatureFile := fs.String("signature", "", "Path to downloaded signature object (<key>.sig)")
+	fs.Parse(args)
+	if *publicKeyFile == "" || *objectKey == "" || *signatureFile == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	rawKey, err := ioutil.ReadFile(*publicKeyFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	publicKey, err := signature.ParsePublicKey(rawKey)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	rawSig, err := ioutil.ReadFile(*signatureFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	sig, err := signature.Parse(rawSig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// chunks are verified as the concatenated artifact
+	readers := []io.Reader{}
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+
+	if err := signature.Verify(publicKey, *objectKey, io.MultiReader(readers...), sig); err != nil {
+		log.Fatalf("Verification failed: %v", err)
+	}
+	fmt.Println(fmt.Sprintf("Signature of `%s` by key %s is valid", *objectKey, sig.KeyID))
+}